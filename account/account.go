@@ -15,13 +15,14 @@ import (
 	"sync/atomic"
 
 	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/metrics"
 )
 
 const (
-	consentURL    = "https://www.tumblr.com/privacy/consent"
-	consentSvcURL = "https://www.tumblr.com/svc/privacy/consent"
-	loginURL      = "https://www.tumblr.com/login"
-	logoutURL     = "https://www.tumblr.com/logout"
+	consentPath    = "/privacy/consent"
+	consentSvcPath = "/svc/privacy/consent"
+	loginPath      = "/login"
+	logoutPath     = "/logout"
 )
 
 var (
@@ -48,11 +49,16 @@ func LoginOnce() error {
 		log.Printf("logging in as %s", sharedConfig.Username)
 
 		err := consent()
-		if err != nil {
-			return err
+		if err == nil {
+			err = login()
 		}
 
-		return login()
+		if err != nil {
+			metrics.LoginAttempts.Inc("failure")
+		} else {
+			metrics.LoginAttempts.Inc("success")
+		}
+		return err
 	})
 }
 
@@ -85,6 +91,10 @@ func transitionLoginState(from, to uint32, f func() error) error {
 	return nil
 }
 
+func webURL(path string) string {
+	return sharedConfig.WebBaseURLOrDefault() + path
+}
+
 func getFormKey(url string) (string, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -117,6 +127,8 @@ func getFormKey(url string) (string, error) {
 }
 
 func consent() error {
+	consentURL := webURL(consentPath)
+
 	formKey, err := getFormKey(consentURL)
 	if err != nil {
 		return err
@@ -143,7 +155,7 @@ func consent() error {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, consentSvcURL, bytes.NewReader(postData))
+	req, err := http.NewRequest(http.MethodPost, webURL(consentSvcPath), bytes.NewReader(postData))
 	if err != nil {
 		return err
 	}
@@ -167,6 +179,8 @@ func consent() error {
 }
 
 func login() error {
+	loginURL := webURL(loginPath)
+
 	formKey, err := getFormKey(loginURL)
 	if err != nil {
 		return err
@@ -201,7 +215,7 @@ func login() error {
 }
 
 func logout() error {
-	req, err := http.NewRequest(http.MethodGet, logoutURL, nil)
+	req, err := http.NewRequest(http.MethodGet, webURL(logoutPath), nil)
 	if err != nil {
 		return err
 	}
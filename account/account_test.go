@@ -0,0 +1,79 @@
+package account
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/cookiejar"
+	"github.com/lhecker/tumblr-scraper/faketumblr"
+)
+
+func setupTestServer(username, password string) *faketumblr.Server {
+	server := faketumblr.NewServer()
+	server.Username = "user@example.com"
+	server.Password = "password"
+
+	Setup(&http.Client{Jar: cookiejar.New(nil)}, &config.Config{
+		Username:   username,
+		Password:   password,
+		WebBaseURL: server.URL,
+	})
+	loginState = 0
+
+	return server
+}
+
+func TestLoginOnce(t *testing.T) {
+	server := setupTestServer("user@example.com", "password")
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		err := LoginOnce()
+		if err != nil {
+			t.Fatalf("failed to log in: %v", err)
+		}
+	}
+	if n := server.Logins(); n != 1 {
+		t.Errorf("logged in %d times, expected once", n)
+	}
+
+	err := Logout()
+	if err != nil {
+		t.Fatalf("failed to log out: %v", err)
+	}
+
+	err = LoginOnce()
+	if err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if n := server.Logins(); n != 2 {
+		t.Errorf("logged in %d times, expected twice", n)
+	}
+}
+
+func TestLoginOnceInvalidCredentials(t *testing.T) {
+	server := setupTestServer("user@example.com", "wrong")
+	defer server.Close()
+
+	err := LoginOnce()
+	if err == nil {
+		t.Fatal("logged in using invalid credentials")
+	}
+	if n := server.Logins(); n != 0 {
+		t.Errorf("logged in %d times, expected never", n)
+	}
+}
+
+func TestLoginOnceMissingCredentials(t *testing.T) {
+	server := setupTestServer("", "")
+	defer server.Close()
+
+	err := LoginOnce()
+	if err == nil {
+		t.Fatal("logged in without credentials")
+	}
+	if n := len(server.Requests()); n != 0 {
+		t.Errorf("sent %d requests, expected none", n)
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -12,14 +13,30 @@ import (
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/lhecker/tumblr-scraper/account"
+	"github.com/lhecker/tumblr-scraper/config"
 	"github.com/lhecker/tumblr-scraper/cookiejar"
+	"github.com/lhecker/tumblr-scraper/database"
+	"github.com/lhecker/tumblr-scraper/scraper"
+	"github.com/lhecker/tumblr-scraper/throttle"
 )
 
 func New() *cli.App {
 	return &cli.App{
 		Name: "tumblr-scraper",
+		Flags: append(newPathFlags(),
+			newEventsFlag(),
+		),
+		Before: setupEvents,
+		After:  closeEvents,
 		Commands: []*cli.Command{
 			newUpdateCommand(),
+			newRetryFailedCommand(),
+			newVerifyCommand(),
+			newDedupeCommand(),
+			newRenderCommand(),
+			newServeCommand(),
+			newDaemonCommand(),
 		},
 	}
 }
@@ -40,20 +57,59 @@ func terminationSignalContext() context.Context {
 	return ctx
 }
 
-func newHTTPClient(jar *cookiejar.Jar) *http.Client {
+// newScraper sets up the HTTP client, account and event stream for the scraper.
+// The returned function saves the session cookies and must be called once the scraper isn't used anymore.
+func newScraper(c *cli.Context, cfg *config.Config, db *database.Database) (*scraper.Scraper, func()) {
+	cookieSnapshot, err := db.GetCookies()
+	if err != nil {
+		log.Printf("failed to get cookie snapshot: %v", err)
+	}
+
+	jar := cookiejar.New(cookieSnapshot)
+	saveCookies := func() {
+		snapshot := jar.Snapshot()
+		err := db.SaveCookies(snapshot)
+		if err != nil {
+			log.Printf("failed to save cookies: %v", err)
+		}
+	}
+
+	httpClient := newHTTPClient(jar, cfg.Network)
+
+	if len(cfg.Username) != 0 {
+		account.Setup(httpClient, cfg)
+	}
+
+	s := scraper.NewScraper(httpClient, cfg, db)
+	if sink := eventSink(c); sink != nil {
+		s.SetEventSink(sink)
+	}
+
+	return s, saveCookies
+}
+
+func newHTTPClient(jar *cookiejar.Jar, network *config.NetworkConfig) *http.Client {
+	var transport http.RoundTripper = &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	if network != nil && len(network.MaxConnsPerHost) != 0 {
+		transport = throttle.NewTransport(transport, network.MaxConnsPerHost)
+	}
+
+	// The timeout doesn't apply to media downloads, which may take arbitrarily long (see scraper.NewScraper).
 	return &http.Client{
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 60 * time.Second,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-		Timeout: 60 * time.Second,
-		Jar:     jar,
+		Transport: transport,
+		Timeout:   60 * time.Second,
+		Jar:       jar,
 	}
 }
 
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+	"github.com/lhecker/tumblr-scraper/scraper"
+	"github.com/lhecker/tumblr-scraper/semaphore"
+)
+
+func newDaemonCommand() *cli.Command {
+	return &cli.Command{
+		Name:    "daemon",
+		Aliases: []string{"watch"},
+		Usage:   "keep running and update each blog periodically according to its update_interval",
+		Flags: []cli.Flag{
+			newMetricsListenFlag(),
+		},
+		Action: handleDaemon,
+	}
+}
+
+func handleDaemon(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, configPath, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// The database is kept open for as long as the daemon is running,
+	// which prevents other commands from modifying it concurrently (see database.ErrLocked).
+	db, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, saveCookies := newScraper(c, cfg, db)
+	defer func() { saveCookies() }()
+
+	stopMetrics := startMetrics(c, cfg, s)
+	defer stopMetrics()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	// Failed updates aren't recorded in the database,
+	// but shouldn't be retried before the next interval either.
+	attempts := make(map[string]time.Time)
+
+	for ctx.Err() == nil {
+		due, next, err := dueBlogs(cfg, db, attempts, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if len(due) != 0 {
+			for _, blog := range due {
+				attempts[blog.Name] = time.Now()
+			}
+			updateBlogs(ctx, cfg, db, s, due)
+			continue
+		}
+
+		if next.IsZero() {
+			log.Print("no blogs configured - waiting for SIGHUP")
+		} else {
+			log.Printf("next update at %s", next.Format("2006-01-02 15:04:05"))
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-timeout:
+		case <-reload:
+			newCfg, err := config.LoadConfigOrDefault(configPath)
+			if err != nil {
+				log.Printf("failed to reload config: %v", err)
+				break
+			}
+
+			// The scraper depends on most of the config (e.g. the concurrency) and is thus simply replaced.
+			saveCookies()
+			cfg = newCfg
+			s, saveCookies = newScraper(c, cfg, db)
+			observeScraper(cfg, s)
+
+			log.Print("reloaded config")
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	log.Print("shutting down")
+	return nil
+}
+
+// dueBlogs returns the blogs whose update interval has passed since their last run or attempt,
+// as well as the time the next blog will become due otherwise.
+func dueBlogs(cfg *config.Config, db *database.Database, attempts map[string]time.Time, now time.Time) ([]*config.BlogConfig, time.Time, error) {
+	var due []*config.BlogConfig
+	var next time.Time
+
+	for _, blog := range cfg.Blogs {
+		last, err := db.GetLastRun(blog.Name)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if attempt := attempts[blog.Name]; attempt.After(last) {
+			last = attempt
+		}
+
+		at := last.Add(cfg.UpdateIntervalOf(blog))
+		if !at.After(now) {
+			due = append(due, blog)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+
+	return due, next, nil
+}
+
+// updateBlogs updates the blogs in parallel according to the parallel_blogs setting.
+// Unlike the update command, a failing blog doesn't stop the others.
+func updateBlogs(ctx context.Context, cfg *config.Config, db *database.Database, s *scraper.Scraper, blogs []*config.BlogConfig) {
+	parallelBlogs := cfg.ParallelBlogs
+	if parallelBlogs <= 0 {
+		parallelBlogs = 1
+	}
+
+	sema := semaphore.NewSemaphore(parallelBlogs)
+	wg := sync.WaitGroup{}
+
+	for _, blog := range blogs {
+		blog := blog
+
+		sema.Acquire()
+		if ctx.Err() != nil {
+			sema.Release()
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sema.Release()
+			_ = updateBlog(ctx, db, s, blog)
+		}()
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+package app
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/scraper"
+)
+
+func newDedupeCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "dedupe",
+		Usage:  "replace files with identical contents across all blogs with links",
+		Action: handleDedupe,
+	}
+}
+
+func handleDedupe(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return scraper.Dedupe(ctx, cfg, db)
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/events"
+)
+
+const (
+	eventSinkMetadataKey = "events"
+	eventFileMetadataKey = "events.file"
+)
+
+func newEventsFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "events",
+		Usage: "write a JSON lines event stream to `FILE` (\"-\" for stderr)",
+	}
+}
+
+// setupEvents opens the event stream selected by the events flag.
+// When writing to stderr the regular log output is turned into events as well, so that the stream stays parseable.
+func setupEvents(c *cli.Context) error {
+	path := c.String("events")
+	if len(path) == 0 {
+		return nil
+	}
+
+	if c.App.Metadata == nil {
+		c.App.Metadata = make(map[string]interface{})
+	}
+
+	var w io.Writer = os.Stderr
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+		c.App.Metadata[eventFileMetadataKey] = f
+	}
+
+	sink := events.NewWriter(w)
+	if path == "-" {
+		log.SetFlags(0)
+		log.SetOutput(events.LogWriter(sink))
+	}
+
+	c.App.Metadata[eventSinkMetadataKey] = sink
+	return nil
+}
+
+func closeEvents(c *cli.Context) error {
+	if f, ok := c.App.Metadata[eventFileMetadataKey].(*os.File); ok {
+		return f.Close()
+	}
+	return nil
+}
+
+// eventSink returns the sink selected by the events flag or nil.
+func eventSink(c *cli.Context) events.Sink {
+	sink, _ := c.App.Metadata[eventSinkMetadataKey].(events.Sink)
+	return sink
+}
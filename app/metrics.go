@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"log"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/metrics"
+	"github.com/lhecker/tumblr-scraper/scraper"
+)
+
+func newMetricsListenFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "metrics-listen",
+		Usage: "serve Prometheus metrics on `ADDRESS` (e.g. localhost:9090) at /metrics",
+	}
+}
+
+// startMetrics serves the metrics if the metrics-listen flag is set.
+// The returned function stops the server.
+func startMetrics(c *cli.Context, cfg *config.Config, s *scraper.Scraper) func() {
+	addr := c.String("metrics-listen")
+	if len(addr) == 0 {
+		return func() {}
+	}
+
+	observeScraper(cfg, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		err := metrics.ListenAndServe(ctx, addr)
+		if err != nil {
+			log.Printf("failed to serve metrics: %v", err)
+		}
+	}()
+
+	return cancel
+}
+
+// observeScraper reports the semaphore state of the blogs of s in the metrics.
+func observeScraper(cfg *config.Config, s *scraper.Scraper) {
+	metrics.SemaphoreQueue.Set(func(report func(v float64, labelValues ...string)) {
+		for _, blog := range cfg.Blogs {
+			queued, active := s.QueueStats(blog.Name)
+			report(float64(queued), blog.Name, "queued")
+			report(float64(active), blog.Name, "active")
+		}
+	})
+}
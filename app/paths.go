@@ -0,0 +1,148 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+const (
+	configFilename   = "tumblr.toml"
+	databaseFilename = "tumblr.db"
+
+	// Name of the directory inside the user's config and data directories.
+	appDirectory = "tumblr-scraper"
+	// Profiles are stored in this directory inside the appDirectory.
+	profilesDirectory = "profiles"
+)
+
+func newPathFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "path to the config `FILE`",
+			EnvVars: []string{"TUMBLR_SCRAPER_CONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "database",
+			Usage:   "path to the database `FILE`",
+			EnvVars: []string{"TUMBLR_SCRAPER_DATABASE"},
+		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "use the config and database of the profile `NAME`",
+			EnvVars: []string{"TUMBLR_SCRAPER_PROFILE"},
+		},
+	}
+}
+
+// loadConfig loads the config selected by the global flags and returns it along with its path.
+func loadConfig(c *cli.Context) (*config.Config, string, error) {
+	path, err := configPath(c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cfg, err := config.LoadConfigOrDefault(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cfg, path, nil
+}
+
+// openDatabase opens the database selected by the global flags, creating its directory if necessary.
+func openDatabase(c *cli.Context) (*database.Database, error) {
+	path, err := databasePath(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return database.NewDatabase(path)
+}
+
+// configPath returns the path of the config file. In order of precedence it's
+//   - the config flag or TUMBLR_SCRAPER_CONFIG
+//   - tumblr.toml inside the profile's directory, if a profile is selected
+//   - tumblr.toml in the working directory, if it or tumblr.db exist there
+//   - tumblr.toml inside the user's config directory (e.g. ~/.config/tumblr-scraper)
+func configPath(c *cli.Context) (string, error) {
+	if path := c.String("config"); len(path) != 0 {
+		return path, nil
+	}
+	return defaultPath(c, configFilename, os.UserConfigDir)
+}
+
+// databasePath is like configPath, but for the database file,
+// which is stored in the user's data directory (e.g. ~/.local/share/tumblr-scraper) by default.
+func databasePath(c *cli.Context) (string, error) {
+	if path := c.String("database"); len(path) != 0 {
+		return path, nil
+	}
+	return defaultPath(c, databaseFilename, userDataDir)
+}
+
+func defaultPath(c *cli.Context, filename string, baseDir func() (string, error)) (string, error) {
+	profile := c.String("profile")
+
+	if len(profile) == 0 && isLegacyWorkingDirectory() {
+		return filename, nil
+	}
+
+	dir, err := baseDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, appDirectory)
+
+	if len(profile) != 0 {
+		if profile == "." || profile == ".." || strings.ContainsAny(profile, `/\`) {
+			return "", fmt.Errorf("invalid profile name %q", profile)
+		}
+		dir = filepath.Join(dir, profilesDirectory, profile)
+	}
+
+	return filepath.Join(dir, filename), nil
+}
+
+// isLegacyWorkingDirectory returns true if the working directory contains a config or database.
+// Previous versions exclusively used the working directory and this keeps existing setups working.
+func isLegacyWorkingDirectory() bool {
+	for _, name := range []string{configFilename, databaseFilename} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// userDataDir returns $XDG_DATA_HOME or its default ~/.local/share on Unix systems.
+// Other systems don't distinguish between config and data, which is why os.UserConfigDir is used there.
+func userDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); len(dir) != 0 {
+		return dir, nil
+	}
+
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9":
+		return os.UserConfigDir()
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
@@ -0,0 +1,32 @@
+package app
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/scraper"
+)
+
+func newRenderCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "render",
+		Usage:  "generate a static HTML site for each blog from its post archive",
+		Action: handleRender,
+	}
+}
+
+func handleRender(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return scraper.Render(ctx, cfg, db)
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"log"
+
+	"github.com/urfave/cli/v2"
+)
+
+func newRetryFailedCommand() *cli.Command {
+	return &cli.Command{
+		Name:   "retry-failed",
+		Usage:  "retry downloads which failed during previous updates",
+		Action: handleRetryFailed,
+	}
+}
+
+func handleRetryFailed(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, saveCookies := newScraper(c, cfg, db)
+	defer saveCookies()
+
+	err = s.RetryFailed(ctx)
+	if err != nil && !isContextCanceledError(err) {
+		log.Println(err)
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/scraper"
+)
+
+func newServeCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "start a local web UI for browsing the scraped blogs",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "listen",
+				Usage: "address to listen on",
+				Value: "localhost:8080",
+			},
+		},
+		Action: handleServe,
+	}
+}
+
+func handleServe(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	dbPath, err := databasePath(c)
+	if err != nil {
+		return err
+	}
+
+	return scraper.Serve(ctx, cfg, dbPath, c.String("listen"))
+}
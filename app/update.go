@@ -1,20 +1,33 @@
 package app
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/sync/errgroup"
 
-	"github.com/lhecker/tumblr-scraper/account"
 	"github.com/lhecker/tumblr-scraper/config"
-	"github.com/lhecker/tumblr-scraper/cookiejar"
 	"github.com/lhecker/tumblr-scraper/database"
+	"github.com/lhecker/tumblr-scraper/events"
+	"github.com/lhecker/tumblr-scraper/progress"
 	"github.com/lhecker/tumblr-scraper/scraper"
+	"github.com/lhecker/tumblr-scraper/semaphore"
 )
 
 func newUpdateCommand() *cli.Command {
 	return &cli.Command{
-		Name:   "update",
+		Name:  "update",
+		Usage: "scrape all configured blogs",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "no-progress",
+				Usage: "print log messages instead of a progress view, even if stdout is a terminal",
+			},
+			newMetricsListenFlag(),
+		},
 		Action: handleUpdate,
 	}
 }
@@ -22,58 +35,89 @@ func newUpdateCommand() *cli.Command {
 func handleUpdate(c *cli.Context) error {
 	ctx := terminationSignalContext()
 
-	configPath := "tumblr.toml"
-	cfg, err := config.LoadConfigOrDefault(configPath)
+	cfg, configPath, err := loadConfig(c)
 	if err != nil {
 		return err
 	}
 
-	db, err := database.NewDatabase()
+	db, err := openDatabase(c)
 	if err != nil {
 		return err
 	}
 
-	cookieSnapshot, err := db.GetCookies()
-	if err != nil {
-		log.Printf("failed to get cookie snapshot: %v", err)
-	}
+	s, saveCookies := newScraper(c, cfg, db)
+	defer saveCookies()
 
-	jar := cookiejar.New(cookieSnapshot)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		snapshot := jar.Snapshot()
-		err := db.SaveCookies(snapshot)
-		if err != nil {
-			log.Printf("failed to save cookies: %v", err)
+	stopMetrics := startMetrics(c, cfg, s)
+	defer stopMetrics()
+
+	if !c.Bool("no-progress") && progress.IsTerminal(os.Stdout) {
+		view := progress.New(os.Stdout, s.QueueStats)
+		s.SetEventSink(events.Multi(eventSink(c), view))
+
+		// With "--events -" the log is already part of the event stream.
+		if c.String("events") != "-" {
+			log.SetOutput(view.LogWriter())
+			defer log.SetOutput(os.Stderr)
 		}
-	}()
 
-	httpClient := newHTTPClient(jar)
+		view.Start()
+		defer view.Stop()
+	}
 
-	if len(cfg.Username) != 0 {
-		account.Setup(httpClient, cfg)
+	parallelBlogs := cfg.ParallelBlogs
+	if parallelBlogs <= 0 {
+		parallelBlogs = 1
 	}
 
-	s := scraper.NewScraper(httpClient, cfg, db)
+	sema := semaphore.NewSemaphore(parallelBlogs)
+	eg, ctx := errgroup.WithContext(ctx)
 
 	for _, blog := range cfg.Blogs {
-		highestPostID, err := s.Scrape(ctx, blog)
-		if err != nil {
-			if !isContextCanceledError(err) {
-				log.Println(err)
-			}
-			return err
+		blog := blog
+
+		sema.Acquire()
+		if ctx.Err() != nil {
+			sema.Release()
+			break
 		}
 
-		err = db.SetHighestID(blog.Name, highestPostID)
-		if err != nil {
+		eg.Go(func() error {
+			defer sema.Release()
+			return updateBlog(ctx, db, s, blog)
+		})
+	}
+
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+
+	cfg.Save(configPath)
+	return nil
+}
+
+// updateBlog scrapes a single blog and records the new highest post ID and the time of the run.
+func updateBlog(ctx context.Context, db *database.Database, s *scraper.Scraper, blog *config.BlogConfig) error {
+	highestPostID, err := s.Scrape(ctx, blog)
+	if err != nil {
+		if !isContextCanceledError(err) {
 			log.Println(err)
-			return err
 		}
+		return err
+	}
+
+	err = db.SetHighestID(blog.Name, highestPostID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	err = db.SetLastRun(blog.Name, time.Now())
+	if err != nil {
+		log.Println(err)
+		return err
 	}
 
-	cfg.Save(configPath)
 	return nil
 }
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"log"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/lhecker/tumblr-scraper/scraper"
+)
+
+func newVerifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "verify",
+		Usage: "check the downloaded files of all blogs for corruption",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "requeue",
+				Usage: "download broken files again",
+			},
+		},
+		Action: handleVerify,
+	}
+}
+
+func handleVerify(c *cli.Context) error {
+	ctx := terminationSignalContext()
+
+	cfg, _, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	requeue := c.Bool("requeue")
+
+	broken, err := scraper.Verify(ctx, cfg, db, requeue)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("found %d broken files", broken)
+	if !requeue || broken == 0 {
+		return nil
+	}
+
+	s, saveCookies := newScraper(c, cfg, db)
+	defer saveCookies()
+
+	err = s.RetryFailed(ctx)
+	if err != nil && !isContextCanceledError(err) {
+		log.Println(err)
+	}
+	return err
+}
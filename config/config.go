@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -14,6 +15,17 @@ import (
 
 const (
 	backupExtension = ".bak"
+
+	DedupeHardlink = "hardlink"
+	DedupeSymlink  = "symlink"
+
+	ExportMarkdown = "markdown"
+	ExportHTML     = "html"
+
+	DefaultAPIBaseURL = "https://api.tumblr.com"
+	DefaultWebBaseURL = "https://www.tumblr.com"
+
+	DefaultUpdateInterval = 24 * time.Hour
 )
 
 type Config struct {
@@ -22,9 +34,27 @@ type Config struct {
 	Blogs  BlogList `toml:"blogs"`
 
 	// Optional
-	Concurrency int    `toml:"concurrency"`
-	Username    string `toml:"username"`
-	Password    string `toml:"password"`
+	Concurrency   int            `toml:"concurrency"`
+	ParallelBlogs int            `toml:"parallel_blogs,omitempty"`
+	Dedupe        string         `toml:"dedupe,omitempty"`
+	Username      string         `toml:"username"`
+	Password      string         `toml:"password"`
+	Retry         *RetryConfig   `toml:"retry,omitempty"`
+	Network       *NetworkConfig `toml:"network,omitempty"`
+
+	// Directory holding the single copy of every deduplicated file, which the target directories link to.
+	// Defaults to "dedupe" next to the database. Hardlinks require it to be on the same file system as the targets.
+	DedupeStore string `toml:"dedupe_store,omitempty"`
+
+	// How often the daemon command updates blogs without their own UpdateInterval
+	UpdateInterval time.Duration `toml:"update_interval,omitempty"`
+
+	// Used for videos embedded from sites other than Tumblr
+	ExternalDownloader *ExternalDownloaderConfig `toml:"external_downloader,omitempty"`
+
+	// Overrides for the Tumblr endpoints (e.g. for a local test server)
+	APIBaseURL string `toml:"api_base_url,omitempty"`
+	WebBaseURL string `toml:"web_base_url,omitempty"`
 }
 
 type BlogConfig struct {
@@ -33,13 +63,82 @@ type BlogConfig struct {
 	Target string `toml:"target"`
 
 	// Optional
-	AllowReblogsFrom *[]string `toml:"allow_reblogs_from"`
-	Before           time.Time `toml:"before,omitempty"`
-	Rescrape         bool      `toml:"rescrape,omitempty"`
+	AllowReblogsFrom *[]string  `toml:"allow_reblogs_from"`
+	ArchivePosts     bool       `toml:"archive_posts,omitempty"`
+	ExportPosts      string     `toml:"export_posts,omitempty"`
+	After            *DateBound `toml:"after,omitempty"`
+	Before           *DateBound `toml:"before,omitempty"`
+	FilenameTemplate string     `toml:"filename_template,omitempty"`
+	IncludeTags      []string   `toml:"include_tags,omitempty"`
+	ExcludeTags      []string   `toml:"exclude_tags,omitempty"`
+	PostTypes        []string   `toml:"post_types,omitempty"`
+	MediaTypes       []string   `toml:"media_types,omitempty"`
+	MinWidth         int        `toml:"min_width,omitempty"`
+	MinHeight        int        `toml:"min_height,omitempty"`
+	Rescrape         bool       `toml:"rescrape,omitempty"`
+
+	// Overrides Config.UpdateInterval
+	UpdateInterval time.Duration `toml:"update_interval,omitempty"`
 }
 
 type BlogList []*BlogConfig
 
+// NetworkConfig limits the network usage of the scraper.
+type NetworkConfig struct {
+	// Maximum number of connections per host.
+	// Keys are either host names or wildcards like "*.media.tumblr.com".
+	MaxConnsPerHost map[string]int `toml:"max_conns_per_host,omitempty"`
+
+	// Maximum download speed in bytes per second for media files. 0 means unlimited.
+	BandwidthLimit int64 `toml:"bandwidth_limit,omitempty"`
+
+	// Overrides the BandwidthLimit during certain times of the day.
+	BandwidthSchedule []*BandwidthWindow `toml:"bandwidth_schedule,omitempty"`
+}
+
+// ExternalDownloaderConfig configures yt-dlp or a compatible program, which is invoked as
+//
+//	{command} {args...} --print after_move:filepath -o {output} -- {url}
+//
+// with the output being an output template based on the blog's FilenameTemplate.
+// The printed path of the downloaded file is recorded in the database.
+type ExternalDownloaderConfig struct {
+	Command string   `toml:"command"`
+	Args    []string `toml:"args,omitempty"`
+}
+
+// BandwidthWindow applies Limit between From and To (local time, formatted as "15:04").
+// Windows may wrap around midnight, e.g. from "22:00" to "06:00".
+type BandwidthWindow struct {
+	From  string `toml:"from"`
+	To    string `toml:"to"`
+	Limit int64  `toml:"limit"`
+}
+
+// Minutes returns From and To as minutes since midnight.
+func (s *BandwidthWindow) Minutes() (int, int, error) {
+	from, err := time.Parse("15:04", s.From)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := time.Parse("15:04", s.To)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return from.Hour()*60 + from.Minute(), to.Hour()*60 + to.Minute(), nil
+}
+
+// RetryConfig controls how often failed requests are retried.
+// Unset fields use the defaults of the scraper.
+type RetryConfig struct {
+	MaxAttempts    int           `toml:"max_attempts,omitempty"`
+	InitialBackoff time.Duration `toml:"initial_backoff,omitempty"`
+	MaxBackoff     time.Duration `toml:"max_backoff,omitempty"`
+	RetryStatuses  []int         `toml:"retry_statuses,omitempty"`
+}
+
 func LoadConfigOrDefault(path string) (*Config, error) {
 	cfg, err := loadConfig(path)
 	if err != nil {
@@ -53,7 +152,8 @@ func LoadConfigOrDefault(path string) (*Config, error) {
 				return nil, err
 			}
 
-			log.Print("config file not found - using default values")
+			log.Printf("config file %s not found - using default values", path)
+			cfg = &Config{}
 		} else {
 			log.Print("recovering backup config file")
 		}
@@ -63,11 +163,44 @@ func LoadConfigOrDefault(path string) (*Config, error) {
 		cfg.Concurrency = 24
 	}
 
+	switch cfg.Dedupe {
+	case "", DedupeHardlink, DedupeSymlink:
+	default:
+		return nil, fmt.Errorf("invalid dedupe mode %q", cfg.Dedupe)
+	}
+
+	if cfg.Network != nil {
+		for _, w := range cfg.Network.BandwidthSchedule {
+			_, _, err = w.Minutes()
+			if err != nil {
+				return nil, fmt.Errorf("invalid bandwidth schedule: %v", err)
+			}
+		}
+	}
+
+	if cfg.UpdateInterval < 0 {
+		return nil, fmt.Errorf("invalid update interval %v", cfg.UpdateInterval)
+	}
+
+	if cfg.ExternalDownloader != nil && len(cfg.ExternalDownloader.Command) == 0 {
+		return nil, fmt.Errorf("missing external downloader command")
+	}
+
 	sort.Stable(cfg.Blogs)
 
 	for _, blog := range cfg.Blogs {
 		blog.Name = TumblrNameToDomain(blog.Name)
 
+		switch blog.ExportPosts {
+		case "", ExportMarkdown, ExportHTML:
+		default:
+			return nil, fmt.Errorf("%s: invalid export format %q", blog.Name, blog.ExportPosts)
+		}
+
+		if blog.UpdateInterval < 0 {
+			return nil, fmt.Errorf("%s: invalid update interval %v", blog.Name, blog.UpdateInterval)
+		}
+
 		if blog.AllowReblogsFrom != nil {
 			for idx, from := range *blog.AllowReblogsFrom {
 				(*blog.AllowReblogsFrom)[idx] = TumblrNameToDomain(from)
@@ -129,6 +262,31 @@ func (s *Config) Save(path string) {
 	return
 }
 
+// UpdateIntervalOf returns how often the blog should be updated by the daemon command.
+func (s *Config) UpdateIntervalOf(blog *BlogConfig) time.Duration {
+	if blog.UpdateInterval > 0 {
+		return blog.UpdateInterval
+	}
+	if s.UpdateInterval > 0 {
+		return s.UpdateInterval
+	}
+	return DefaultUpdateInterval
+}
+
+func (s *Config) APIBaseURLOrDefault() string {
+	if len(s.APIBaseURL) != 0 {
+		return strings.TrimSuffix(s.APIBaseURL, "/")
+	}
+	return DefaultAPIBaseURL
+}
+
+func (s *Config) WebBaseURLOrDefault() string {
+	if len(s.WebBaseURL) != 0 {
+		return strings.TrimSuffix(s.WebBaseURL, "/")
+	}
+	return DefaultWebBaseURL
+}
+
 func (s BlogList) Len() int {
 	return len(s)
 }
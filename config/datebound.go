@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dateBoundLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	// The format TOML datetime literals arrive in, see DateBound.UnmarshalText.
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// DateBound is either an absolute point in time or one relative to the
+// start of the scrape, like "last 30 days", "2 weeks ago" or "720h".
+type DateBound struct {
+	text     string
+	absolute time.Time
+
+	years    int
+	months   int
+	days     int
+	duration time.Duration
+}
+
+// Resolve returns the point in time s refers to relative to now.
+func (s *DateBound) Resolve(now time.Time) time.Time {
+	if !s.absolute.IsZero() {
+		return s.absolute
+	}
+	return now.AddDate(-s.years, -s.months, -s.days).Add(-s.duration)
+}
+
+func (s *DateBound) String() string {
+	return s.text
+}
+
+func (s DateBound) MarshalText() ([]byte, error) {
+	return []byte(s.text), nil
+}
+
+// UnmarshalText parses both strings and TOML datetime literals.
+// The latter are passed as their fmt.Sprint representation by go-toml.
+func (s *DateBound) UnmarshalText(data []byte) error {
+	text := strings.TrimSpace(string(data))
+	*s = DateBound{text: text}
+
+	for _, layout := range dateBoundLayouts {
+		t, err := time.Parse(layout, text)
+		if err == nil {
+			s.absolute = t
+			// Normalize the text, so that Save() writes the bound back in a format we understand.
+			s.text = t.Format(time.RFC3339Nano)
+			return nil
+		}
+	}
+
+	d, err := time.ParseDuration(text)
+	if err == nil {
+		if d <= 0 {
+			return fmt.Errorf("invalid date %q: duration must be positive", text)
+		}
+		s.duration = d
+		return nil
+	}
+
+	// "last 30 days" or "30 days ago"
+	fields := strings.Fields(strings.ToLower(text))
+	switch {
+	case len(fields) == 3 && fields[0] == "last":
+		fields = fields[1:]
+	case len(fields) == 3 && fields[2] == "ago":
+		fields = fields[:2]
+	default:
+		return fmt.Errorf("invalid date %q", text)
+	}
+
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid date %q", text)
+	}
+
+	switch strings.TrimSuffix(fields[1], "s") {
+	case "hour":
+		s.duration = time.Duration(n) * time.Hour
+	case "day":
+		s.days = n
+	case "week":
+		s.days = 7 * n
+	case "month":
+		s.months = n
+	case "year":
+		s.years = n
+	default:
+		return fmt.Errorf("invalid date %q: unknown unit %q", text, fields[1])
+	}
+
+	return nil
+}
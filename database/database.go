@@ -1,27 +1,189 @@
 package database
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
 	"strconv"
+	"time"
 
 	"go.etcd.io/bbolt"
 )
 
 var (
-	stateBucket     = []byte("state")
-	highestIDBucket = []byte("highest_id")
+	stateBucket      = []byte("state")
+	highestIDBucket  = []byte("highest_id")
+	checkpointBucket = []byte("checkpoint")
+	mediaBucket      = []byte("media")
+	mediaURLBucket   = []byte("media_url")
+	failedBucket     = []byte("failed_downloads")
+	filesBucket      = []byte("files")
+	coverageBucket   = []byte("coverage")
+	externalBucket   = []byte("external_downloads")
+	lastRunBucket    = []byte("last_run")
 )
 
+// ErrLocked is returned if the database is opened by another process, e.g. a running daemon.
+var ErrLocked = errors.New("database is in use by another process")
+
+// ErrSnapshotUnstable is returned by NewSnapshot if the database is modified faster than it can be copied.
+var ErrSnapshotUnstable = errors.New("database changed during every attempt at copying it")
+
+// Opening the database fails with ErrLocked after this long, instead of waiting for the other process indefinitely.
+const lockTimeout = time.Second
+
+// NewSnapshot gives up with ErrSnapshotUnstable after this many attempts.
+const snapshotAttempts = 5
+
 type Database bbolt.DB
 
-func NewDatabase() (*Database, error) {
-	db, err := bbolt.Open("tumblr.db", 0644, nil)
+// RateLimit is the quota consumption of a rate limit window (e.g. per hour or per day) of the Tumblr API.
+type RateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// FailedDownload is a file which couldn't be downloaded, even after retrying.
+type FailedDownload struct {
+	Blog     string    `json:"blog"`
+	PostID   int64     `json:"post_id"`
+	URL      string    `json:"url"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+
+	// Index of the file within the post and the post's JSON,
+	// required to reconstruct the path of the file.
+	Index int             `json:"index"`
+	Post  json.RawMessage `json:"post,omitempty"`
+
+	// Set if the file has to be downloaded using the external downloader.
+	External bool `json:"external,omitempty"`
+
+	// Set for files requeued by Verify, whose post is unknown. They're downloaded to
+	// exactly this path instead and retain the modification time of the broken file.
+	Path     string    `json:"path,omitempty"`
+	FileTime time.Time `json:"file_time"`
+}
+
+// ExternalDownload records a successful download using the external downloader.
+type ExternalDownload struct {
+	Blog         string    `json:"blog"`
+	PostID       int64     `json:"post_id"`
+	URL          string    `json:"url"`
+	Output       string    `json:"output"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// FileRecord describes a downloaded file at the time it was written.
+type FileRecord struct {
+	Blog   string `json:"blog"`
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// See FailedDownload.
+	PostID int64 `json:"post_id"`
+	Index  int   `json:"index"`
+}
+
+// Checkpoint is the pagination state of an unfinished scrape of a blog.
+type Checkpoint struct {
+	Offset    int       `json:"offset"`
+	Before    time.Time `json:"before"`
+	LowestID  int64     `json:"lowest_id"`
+	HighestID int64     `json:"highest_id"`
+
+	// The time the scrape started at, see DateRange.
+	Top time.Time `json:"top"`
+}
+
+// DateRange is a range of time in which all posts of a blog have been scraped.
+// A zero From refers to the beginning of the blog.
+type DateRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// NewDatabase opens the database at path, creating it if necessary.
+func NewDatabase(path string) (*Database, error) {
+	return openDatabase(path)
+}
+
+// NewSnapshot copies the database at src to dst and opens the copy.
+// This allows reading the database while another process (e.g. a running scrape) holds the lock on it.
+// Changes made to the snapshot are not written back.
+// ErrSnapshotUnstable is returned if the database kept changing during every attempt at copying it.
+func NewSnapshot(src string, dst string) (*Database, error) {
+	for attempt := 1; ; attempt++ {
+		before, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+
+		err = copyFile(dst, src)
+		if err != nil {
+			return nil, err
+		}
+
+		// Retry if the database was modified while copying it.
+		after, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if after.ModTime().Equal(before.ModTime()) && after.Size() == before.Size() {
+			break
+		}
+		if attempt == snapshotAttempts {
+			_ = os.Remove(dst)
+			return nil, ErrSnapshotUnstable
+		}
+	}
+
+	return openDatabase(dst)
+}
+
+func copyFile(dst string, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func openDatabase(path string) (*Database, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: lockTimeout})
+	if err == bbolt.ErrTimeout {
+		return nil, ErrLocked
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(highestIDBucket)
-		return err
+		for _, name := range [][]byte{highestIDBucket, checkpointBucket, mediaBucket, mediaURLBucket, failedBucket, filesBucket, coverageBucket, externalBucket, lastRunBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -30,6 +192,11 @@ func NewDatabase() (*Database, error) {
 	return (*Database)(db), nil
 }
 
+// Path returns the path of the database file.
+func (s *Database) Path() string {
+	return s.get().Path()
+}
+
 func (s *Database) Close() error {
 	return s.get().Close()
 }
@@ -82,6 +249,48 @@ func (s *Database) GetHighestID(blogName string) (int64, error) {
 	return highestID, nil
 }
 
+// GetRateLimits returns the last known rate limits keyed by their window.
+func (s *Database) GetRateLimits() (map[string]*RateLimit, error) {
+	rateLimits := make(map[string]*RateLimit)
+
+	err := s.get().Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+
+		data := b.Get([]byte("rate_limits"))
+		if len(data) == 0 {
+			return nil
+		}
+
+		return json.Unmarshal(data, &rateLimits)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rateLimits, nil
+}
+
+func (s *Database) SaveRateLimits(rateLimits map[string]*RateLimit) error {
+	data, err := json.Marshal(rateLimits)
+	if err != nil {
+		return err
+	}
+
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("rate_limits"), data)
+	})
+}
+
+// SetHighestID marks the scrape of a blog as finished up to highestID.
+// Any checkpoint of the blog is removed in the same transaction.
 func (s *Database) SetHighestID(blogName string, highestID int64) error {
 	return s.get().Update(func(tx *bbolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists(highestIDBucket)
@@ -90,7 +299,293 @@ func (s *Database) SetHighestID(blogName string, highestID int64) error {
 		}
 
 		s := strconv.FormatInt(highestID, 10)
-		return b.Put([]byte(blogName), []byte(s))
+		err = b.Put([]byte(blogName), []byte(s))
+		if err != nil {
+			return err
+		}
+
+		b, err = tx.CreateBucketIfNotExists(checkpointBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(blogName))
+	})
+}
+
+// GetCheckpoint returns nil if the last scrape of the blog finished.
+func (s *Database) GetCheckpoint(blogName string) (*Checkpoint, error) {
+	var checkpoint *Checkpoint
+
+	err := s.get().Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(checkpointBucket)
+		if err != nil {
+			return err
+		}
+
+		data := b.Get([]byte(blogName))
+		if len(data) == 0 {
+			return nil
+		}
+
+		checkpoint = &Checkpoint{}
+		return json.Unmarshal(data, checkpoint)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+func (s *Database) SaveCheckpoint(blogName string, checkpoint *Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(checkpointBucket)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(blogName), data)
+	})
+}
+
+// GetMediaPath returns the path of the stored copy of the file with the given SHA-256 hash or "" if it's unknown.
+func (s *Database) GetMediaPath(hash string) (path string, err error) {
+	err = s.get().View(func(tx *bbolt.Tx) error {
+		path = string(tx.Bucket(mediaBucket).Get([]byte(hash)))
+		return nil
+	})
+	return
+}
+
+func (s *Database) SetMediaPath(hash string, path string) error {
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(mediaBucket).Put([]byte(hash), []byte(path))
+	})
+}
+
+// GetURLHash returns the SHA-256 hash of the file last downloaded from rawurl or "" if it's unknown.
+func (s *Database) GetURLHash(rawurl string) (hash string, err error) {
+	err = s.get().View(func(tx *bbolt.Tx) error {
+		hash = string(tx.Bucket(mediaURLBucket).Get([]byte(rawurl)))
+		return nil
+	})
+	return
+}
+
+func (s *Database) SetURLHash(rawurl string, hash string) error {
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(mediaURLBucket).Put([]byte(rawurl), []byte(hash))
+	})
+}
+
+// AddFailedDownload records a failed download.
+// The attempts of previous failures of the same URL are added to those of failed.
+func (s *Database) AddFailedDownload(failed *FailedDownload) error {
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(failedBucket)
+		key := failedDownloadKey(failed.Blog, failed.URL)
+
+		data := b.Get(key)
+		if len(data) != 0 {
+			previous := &FailedDownload{}
+			err := json.Unmarshal(data, previous)
+			if err == nil {
+				failed.Attempts += previous.Attempts
+			}
+		}
+
+		data, err := json.Marshal(failed)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(key, data)
+	})
+}
+
+func (s *Database) GetFailedDownloads() ([]*FailedDownload, error) {
+	var failed []*FailedDownload
+
+	err := s.get().View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(failedBucket).ForEach(func(k, v []byte) error {
+			fd := &FailedDownload{}
+			err := json.Unmarshal(v, fd)
+			if err != nil {
+				return err
+			}
+
+			failed = append(failed, fd)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return failed, nil
+}
+
+func (s *Database) DeleteFailedDownload(blogName string, rawurl string) error {
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(failedBucket).Delete(failedDownloadKey(blogName, rawurl))
+	})
+}
+
+func failedDownloadKey(blogName string, rawurl string) []byte {
+	return []byte(blogName + "\x00" + rawurl)
+}
+
+// GetFileRecord returns nil if no record exists for the given path.
+func (s *Database) GetFileRecord(path string) (*FileRecord, error) {
+	var record *FileRecord
+
+	err := s.get().View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(filesBucket).Get([]byte(path))
+		if len(data) == 0 {
+			return nil
+		}
+
+		record = &FileRecord{}
+		return json.Unmarshal(data, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (s *Database) SetFileRecord(path string, record *FileRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(path), data)
+	})
+}
+
+// GetExternalDownload returns nil if the URL hasn't been downloaded for the blog yet.
+func (s *Database) GetExternalDownload(blogName string, rawurl string) (*ExternalDownload, error) {
+	var download *ExternalDownload
+
+	err := s.get().View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(externalBucket).Get(failedDownloadKey(blogName, rawurl))
+		if len(data) == 0 {
+			return nil
+		}
+
+		download = &ExternalDownload{}
+		return json.Unmarshal(data, download)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return download, nil
+}
+
+func (s *Database) SetExternalDownload(download *ExternalDownload) error {
+	data, err := json.Marshal(download)
+	if err != nil {
+		return err
+	}
+
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(externalBucket).Put(failedDownloadKey(download.Blog, download.URL), data)
+	})
+}
+
+// GetCoverage returns the sorted, non-overlapping date ranges which have been scraped for the blog.
+func (s *Database) GetCoverage(blogName string) ([]DateRange, error) {
+	var coverage []DateRange
+
+	err := s.get().View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(coverageBucket).Get([]byte(blogName))
+		if len(data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(data, &coverage)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return coverage, nil
+}
+
+// AddCoverage merges r into the date ranges which have been scraped for the blog.
+func (s *Database) AddCoverage(blogName string, r DateRange) error {
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(coverageBucket)
+
+		var coverage []DateRange
+		data := b.Get([]byte(blogName))
+		if len(data) != 0 {
+			err := json.Unmarshal(data, &coverage)
+			if err != nil {
+				return err
+			}
+		}
+
+		merged := make([]DateRange, 0, len(coverage)+1)
+		for _, c := range coverage {
+			if c.To.Before(r.From) || r.To.Before(c.From) {
+				merged = append(merged, c)
+				continue
+			}
+			if c.From.Before(r.From) {
+				r.From = c.From
+			}
+			if c.To.After(r.To) {
+				r.To = c.To
+			}
+		}
+		merged = append(merged, r)
+
+		sort.Slice(merged, func(i, j int) bool {
+			return merged[i].From.Before(merged[j].From)
+		})
+
+		data, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(blogName), data)
+	})
+}
+
+// GetLastRun returns the time the blog was last scraped successfully, or the zero time if it never was.
+func (s *Database) GetLastRun(blogName string) (time.Time, error) {
+	var lastRun time.Time
+
+	err := s.get().View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(lastRunBucket).Get([]byte(blogName))
+		if len(data) == 0 {
+			return nil
+		}
+		return lastRun.UnmarshalText(data)
+	})
+
+	return lastRun, err
+}
+
+func (s *Database) SetLastRun(blogName string, lastRun time.Time) error {
+	data, err := lastRun.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return s.get().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(lastRunBucket).Put([]byte(blogName), data)
 	})
 }
 
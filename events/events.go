@@ -0,0 +1,138 @@
+// Package events implements a machine-readable stream of the scraper's progress.
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	PageFetched  = "page_fetched"
+	PostScraped  = "post_scraped"
+	FileWritten  = "file_written"
+	FileSkipped  = "file_skipped"
+	FileFailed   = "file_failed"
+	BlogFinished = "blog_finished"
+
+	// Log contains a line written using the log package.
+	Log = "log"
+)
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Blog    string    `json:"blog,omitempty"`
+	PostID  int64     `json:"post_id,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Message string    `json:"message,omitempty"`
+
+	// PageFetched: The 1-based number of the page, the number of posts on it
+	// and the total number of posts of the blog, if reported by the API.
+	Page       int   `json:"page,omitempty"`
+	Posts      int   `json:"posts,omitempty"`
+	TotalPosts int64 `json:"total_posts,omitempty"`
+
+	// PostScraped: The number of files queued for download and whether the post was filtered out.
+	Files   int  `json:"files,omitempty"`
+	Skipped bool `json:"skipped,omitempty"`
+
+	// FileWritten: Set if the file was linked to an identical one instead of downloading it.
+	Linked bool `json:"linked,omitempty"`
+
+	// FileFailed
+	Attempts int `json:"attempts,omitempty"`
+
+	// BlogFinished
+	HighestID int64  `json:"highest_id,omitempty"`
+	Stats     *Stats `json:"stats,omitempty"`
+}
+
+// Stats are the totals of a blog's scrape.
+type Stats struct {
+	Pages        int64 `json:"pages"`
+	Posts        int64 `json:"posts"`
+	FilesWritten int64 `json:"files_written"`
+	FilesSkipped int64 `json:"files_skipped"`
+	FilesFailed  int64 `json:"files_failed"`
+	Bytes        int64 `json:"bytes"`
+}
+
+// Add adds the totals of other to s.
+func (s *Stats) Add(other *Stats) {
+	s.Pages += other.Pages
+	s.Posts += other.Posts
+	s.FilesWritten += other.FilesWritten
+	s.FilesSkipped += other.FilesSkipped
+	s.FilesFailed += other.FilesFailed
+	s.Bytes += other.Bytes
+}
+
+// Sink receives events. Implementations must be safe for concurrent use.
+type Sink interface {
+	Emit(e *Event)
+}
+
+// Multi returns a Sink emitting events to all of the given sinks, which may be nil.
+func Multi(sinks ...Sink) Sink {
+	var m multiSink
+	for _, sink := range sinks {
+		if sink != nil {
+			m = append(m, sink)
+		}
+	}
+	return m
+}
+
+type multiSink []Sink
+
+func (m multiSink) Emit(e *Event) {
+	for _, sink := range m {
+		sink.Emit(e)
+	}
+}
+
+// Writer is a Sink writing events as JSON lines.
+type Writer struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{encoder: json.NewEncoder(w)}
+}
+
+func (s *Writer) Emit(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_ = s.encoder.Encode(e)
+}
+
+// LogWriter returns a writer for log.SetOutput which emits each line as a Log event.
+// This prevents plain text from being interleaved with the event stream.
+func LogWriter(sink Sink) io.Writer {
+	return &logWriter{sink}
+}
+
+type logWriter struct {
+	sink Sink
+}
+
+func (s *logWriter) Write(p []byte) (int, error) {
+	s.sink.Emit(&Event{
+		Type:    Log,
+		Message: string(bytes.TrimRight(p, "\n")),
+	})
+	return len(p), nil
+}
@@ -0,0 +1,306 @@
+// Package faketumblr implements an in-process fake of the Tumblr endpoints used by the scraper.
+//
+// The server is meant to be used by setting config.Config.APIBaseURL and
+// config.Config.WebBaseURL to the URL of the server.
+package faketumblr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormKey = "fake-form-key"
+
+	loginCookieName = "logged_in"
+	postsPageSize   = 20
+)
+
+// Post is a post served by the fake API.
+// Fields contains all other fields of the post's JSON, e.g. "content", "trail" or "reblogged_root_name".
+type Post struct {
+	ID        int64
+	Timestamp int64
+	Fields    map[string]interface{}
+}
+
+func (s *Post) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(s.Fields)+2)
+	for k, v := range s.Fields {
+		m[k] = v
+	}
+	m["id"] = s.ID
+	m["timestamp"] = s.Timestamp
+	return json.Marshal(m)
+}
+
+func (s *Post) hasTag(tag string) bool {
+	tags, _ := s.Fields["tags"].([]string)
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+type blog struct {
+	posts []*Post
+
+	// Private blogs can only be accessed using the indash API after logging in.
+	private bool
+}
+
+type media struct {
+	contentType string
+	data        []byte
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+}
+
+type Server struct {
+	*httptest.Server
+
+	Username string
+	Password string
+
+	lock     sync.Mutex
+	blogs    map[string]*blog
+	media    map[string]*media
+	requests []Request
+	logins   int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		blogs: make(map[string]*blog),
+		media: make(map[string]*media),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/blog/", s.handleAPIPosts)
+	mux.HandleFunc("/svc/indash_blog", s.handleIndashBlog)
+	mux.HandleFunc("/privacy/consent", s.handleFormKeyPage)
+	mux.HandleFunc("/svc/privacy/consent", s.handleConsent)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/logout", s.handleLogout)
+	mux.HandleFunc("/media/", s.handleMedia)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.requests = append(s.requests, Request{r.Method, r.URL.Path, r.URL.RawQuery})
+		s.lock.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+
+	return s
+}
+
+// AddBlog adds the posts to the blog with the given domain (e.g. "example.tumblr.com").
+func (s *Server) AddBlog(domain string, private bool, posts ...*Post) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b := s.blogs[domain]
+	if b == nil {
+		b = &blog{}
+		s.blogs[domain] = b
+	}
+
+	b.private = private
+	b.posts = append(b.posts, posts...)
+
+	// Just like Tumblr the posts are served newest first.
+	sort.SliceStable(b.posts, func(i, j int) bool {
+		return b.posts[i].ID > b.posts[j].ID
+	})
+}
+
+// AddMedia registers a file and returns the URL it's served at.
+func (s *Server) AddMedia(name string, contentType string, data []byte) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.media[name] = &media{contentType, data}
+	return s.URL + "/media/" + name
+}
+
+// Requests returns all requests received so far.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Logins returns the number of successful logins.
+func (s *Server) Logins() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.logins
+}
+
+func (s *Server) getBlog(domain string) *blog {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.blogs[domain]
+}
+
+func (s *Server) handleAPIPosts(w http.ResponseWriter, r *http.Request) {
+	// /v2/blog/{domain}/posts
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[3] != "posts" {
+		http.NotFound(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if len(query.Get("api_key")) == 0 {
+		http.Error(w, "missing api_key", http.StatusUnauthorized)
+		return
+	}
+
+	b := s.getBlog(parts[2])
+	if b == nil || b.private {
+		http.NotFound(w, r)
+		return
+	}
+
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	tag := query.Get("tag")
+
+	posts := make([]*Post, 0, postsPageSize)
+	for _, p := range b.posts {
+		if before != 0 && p.Timestamp >= before {
+			continue
+		}
+		if len(tag) != 0 && !p.hasTag(tag) {
+			continue
+		}
+		posts = append(posts, p)
+		if len(posts) == postsPageSize {
+			break
+		}
+	}
+
+	writePosts(w, posts, len(b.posts))
+}
+
+func (s *Server) handleIndashBlog(w http.ResponseWriter, r *http.Request) {
+	if !isLoggedIn(r) {
+		http.Error(w, "login required", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	b := s.getBlog(query.Get("tumblelog_name_or_id") + ".tumblr.com")
+	if b == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset > len(b.posts) {
+		offset = len(b.posts)
+	}
+
+	end := offset + postsPageSize
+	if end > len(b.posts) {
+		end = len(b.posts)
+	}
+
+	writePosts(w, b.posts[offset:end], len(b.posts))
+}
+
+func (s *Server) handleFormKeyPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<html><head><meta name="tumblr-form-key" id="tumblr_form_key" content="%s"></head></html>`, FormKey)
+}
+
+func (s *Server) handleConsent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("X-tumblr-form-key") != FormKey {
+		http.Error(w, "invalid form key", http.StatusBadRequest)
+		return
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.handleFormKeyPage(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("form_key") != FormKey ||
+		r.PostForm.Get("user[email]") != s.Username ||
+		r.PostForm.Get("user[password]") != s.Password {
+		http.Error(w, "invalid credentials", http.StatusForbidden)
+		return
+	}
+
+	s.lock.Lock()
+	s.logins++
+	s.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Value: "1", Path: "/"})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Value: "", Path: "/", MaxAge: -1})
+}
+
+func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	m := s.media[strings.TrimPrefix(r.URL.Path, "/media/")]
+	s.lock.Unlock()
+
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ServeContent supports Range requests for resumed downloads.
+	w.Header().Set("Content-Type", m.contentType)
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(m.data))
+}
+
+func isLoggedIn(r *http.Request) bool {
+	c, err := r.Cookie(loginCookieName)
+	return err == nil && c.Value == "1"
+}
+
+func writePosts(w http.ResponseWriter, posts []*Post, total int) {
+	data := struct {
+		Response struct {
+			Posts      []*Post `json:"posts"`
+			TotalPosts int     `json:"total_posts"`
+		} `json:"response"`
+	}{}
+	data.Response.Posts = posts
+	data.Response.TotalPosts = total
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&data)
+}
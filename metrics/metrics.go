@@ -0,0 +1,259 @@
+// Package metrics implements counters, histograms and gauges which can be exposed in the Prometheus text format.
+//
+// See: https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	Requests = NewCounterVec(
+		"tumblr_scraper_requests_total",
+		"Number of HTTP requests by endpoint and status code.",
+		"endpoint", "status",
+	)
+	DownloadedBytes = NewCounterVec(
+		"tumblr_scraper_downloaded_bytes_total",
+		"Number of bytes written to downloaded files.",
+		"blog",
+	)
+	DownloadDuration = NewHistogram(
+		"tumblr_scraper_download_duration_seconds",
+		"Time it took to download a file, from sending the request to the file being complete.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	)
+	SemaphoreQueue = NewGaugeFunc(
+		"tumblr_scraper_semaphore_requests",
+		"Number of requests waiting for or holding a slot of the concurrency limit.",
+		"blog", "state",
+	)
+	LoginAttempts = NewCounterVec(
+		"tumblr_scraper_login_attempts_total",
+		"Number of attempts to log into the Tumblr account by result.",
+		"result",
+	)
+)
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	registry = append(registry, c)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func WriteTo(w io.Writer) error {
+	registryLock.Lock()
+	collectors := append([]collector(nil), registry...)
+	registryLock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// CounterVec is a set of counters, which are partitioned by the values of its labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for the given label values, which must be passed in the order of the labels.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		writeSample(w, c.name, key, c.values[key])
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the given upper bounds of its buckets in increasing order.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, le := range h.buckets {
+		writeSample(w, h.name+"_bucket", formatLabels([]string{"le"}, []string{formatFloat(le)}), float64(h.counts[i]))
+	}
+	writeSample(w, h.name+"_bucket", formatLabels([]string{"le"}, []string{"+Inf"}), float64(h.count))
+	writeSample(w, h.name+"_sum", "", h.sum)
+	writeSample(w, h.name+"_count", "", float64(h.count))
+}
+
+// GaugeFunc is a set of gauges, whose values are reported by a function whenever they're collected.
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+
+	lock sync.Mutex
+	fn   func(report func(v float64, labelValues ...string))
+}
+
+func NewGaugeFunc(name string, help string, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		name:   name,
+		help:   help,
+		labels: labels,
+	}
+	register(g)
+	return g
+}
+
+// Set replaces the function reporting the values of the gauges.
+func (g *GaugeFunc) Set(fn func(report func(v float64, labelValues ...string))) {
+	g.lock.Lock()
+	g.fn = fn
+	g.lock.Unlock()
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+
+	g.lock.Lock()
+	fn := g.fn
+	g.lock.Unlock()
+
+	if fn != nil {
+		fn(func(v float64, labelValues ...string) {
+			writeSample(w, g.name, formatLabels(g.labels, labelValues), v)
+		})
+	}
+}
+
+func writeHeader(w *bufio.Writer, name string, help string, typ string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, v float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string, values []string) string {
+	if len(labels) != len(values) {
+		panic("wrong number of label values")
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// Handler serves all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := WriteTo(w)
+		if err != nil {
+			log.Printf("failed to write metrics: %v", err)
+		}
+	})
+}
+
+// ListenAndServe serves the metrics on addr at /metrics until ctx is done.
+func ListenAndServe(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	log.Printf("serving metrics on http://%s/metrics", addr)
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
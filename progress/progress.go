@@ -0,0 +1,256 @@
+// Package progress implements a live view of the scraper's progress for terminals.
+package progress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/events"
+)
+
+const redrawInterval = 500 * time.Millisecond
+
+// IsTerminal returns true if f refers to a terminal (or console) as opposed to a file or pipe.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// QueueFunc returns the number of requests of a blog waiting for and holding a download slot.
+type QueueFunc func(blogName string) (queued int, active int)
+
+// View is an events.Sink which redraws a summary line per blog in place,
+// instead of printing a log line per file.
+type View struct {
+	w     io.Writer
+	queue QueueFunc
+	width int
+
+	// Protects all fields below.
+	lock    sync.Mutex
+	blogs   []*blogProgress
+	byName  map[string]*blogProgress
+	message string
+	lines   int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type blogProgress struct {
+	name     string
+	started  time.Time
+	finished time.Duration
+	done     bool
+
+	pages      int64
+	posts      int64
+	totalPosts int64
+	written    int64
+	skipped    int64
+	failed     int64
+	bytes      int64
+}
+
+func New(w io.Writer, queue QueueFunc) *View {
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 80
+	}
+
+	return &View{
+		w:      w,
+		queue:  queue,
+		width:  width,
+		byName: make(map[string]*blogProgress),
+	}
+}
+
+// Start periodically redraws the view until Stop is called.
+func (v *View) Start() {
+	v.stop = make(chan struct{})
+	v.stopped = make(chan struct{})
+
+	go func() {
+		defer close(v.stopped)
+
+		ticker := time.NewTicker(redrawInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				v.redraw("")
+			case <-v.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the view a final time and leaves it on the screen.
+func (v *View) Stop() {
+	close(v.stop)
+	<-v.stopped
+
+	v.lock.Lock()
+	v.message = ""
+	v.lock.Unlock()
+
+	v.redraw("")
+}
+
+// LogWriter returns a writer for log.SetOutput which shows the latest log line below the view,
+// instead of letting the log scroll the view off the screen.
+func (v *View) LogWriter() io.Writer {
+	return logWriter{v}
+}
+
+type logWriter struct {
+	v *View
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.v.lock.Lock()
+	// The view assumes that each line occupies exactly one row.
+	w.v.message = string(bytes.Replace(bytes.TrimRight(p, "\n"), []byte("\n"), []byte(" "), -1))
+	w.v.lock.Unlock()
+	return len(p), nil
+}
+
+func (v *View) Emit(e *events.Event) {
+	v.lock.Lock()
+
+	b := v.byName[e.Blog]
+	if b == nil {
+		b = &blogProgress{name: e.Blog, started: time.Now()}
+		v.byName[e.Blog] = b
+		v.blogs = append(v.blogs, b)
+	}
+
+	// Failures are kept on the screen above the view, since they might require attention.
+	persistent := ""
+
+	switch e.Type {
+	case events.PageFetched:
+		b.pages++
+		if e.TotalPosts > b.totalPosts {
+			b.totalPosts = e.TotalPosts
+		}
+	case events.PostScraped:
+		b.posts++
+	case events.FileWritten:
+		b.written++
+		b.bytes += e.Bytes
+	case events.FileSkipped:
+		b.skipped++
+	case events.FileFailed:
+		b.failed++
+		persistent = fmt.Sprintf("%s: failed to download %s: %s", e.Blog, e.URL, e.Error)
+	case events.BlogFinished:
+		b.done = true
+		b.finished = time.Since(b.started)
+	}
+
+	v.lock.Unlock()
+
+	if len(persistent) != 0 {
+		v.redraw(persistent)
+	}
+}
+
+// redraw replaces the previously drawn view, optionally printing a line above it which isn't overwritten later on.
+func (v *View) redraw(persistent string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var buf bytes.Buffer
+
+	// Move the cursor to the beginning of the view and clear everything below.
+	if v.lines != 0 {
+		fmt.Fprintf(&buf, "\x1b[%dA", v.lines)
+	}
+	buf.WriteString("\r\x1b[J")
+
+	if len(persistent) != 0 {
+		buf.WriteString(persistent)
+		buf.WriteByte('\n')
+	}
+
+	lines := make([]string, 0, len(v.blogs)+1)
+	for _, b := range v.blogs {
+		lines = append(lines, v.blogLine(b))
+	}
+	if len(v.message) != 0 {
+		lines = append(lines, v.message)
+	}
+
+	for _, line := range lines {
+		buf.WriteString(v.truncate(line))
+		buf.WriteByte('\n')
+	}
+	v.lines = len(lines)
+
+	_, _ = v.w.Write(buf.Bytes())
+}
+
+func (v *View) blogLine(b *blogProgress) string {
+	files := b.written + b.skipped + b.failed
+
+	if b.done {
+		return fmt.Sprintf("%s: finished in %s - %d posts, %d files (%d new, %d failed), %s",
+			b.name, b.finished.Round(time.Second), b.posts, files, b.written, b.failed, formatBytes(b.bytes))
+	}
+
+	elapsed := time.Since(b.started)
+	queued, active := 0, 0
+	if v.queue != nil {
+		queued, active = v.queue(b.name)
+	}
+
+	posts := strconv.FormatInt(b.posts, 10)
+	eta := "-"
+	if b.totalPosts != 0 {
+		posts += "/" + strconv.FormatInt(b.totalPosts, 10)
+
+		// Incremental updates usually stop long before reaching the last post, making this an upper bound.
+		if remaining := b.totalPosts - b.posts; remaining > 0 && b.posts > 0 {
+			eta = (elapsed * time.Duration(remaining) / time.Duration(b.posts)).Round(time.Second).String()
+		}
+	}
+
+	throughput := int64(0)
+	if elapsed > 0 {
+		throughput = int64(float64(b.bytes) / elapsed.Seconds())
+	}
+
+	return fmt.Sprintf("%s: %s posts, %d pages | %s/s, ETA %s | %d queued, %d active, %d done, %d failed",
+		b.name, posts, b.pages, formatBytes(throughput), eta, queued, active, files, b.failed)
+}
+
+func (v *View) truncate(line string) string {
+	runes := []rune(line)
+	if len(runes) < v.width {
+		return line
+	}
+	return string(runes[:v.width-1])
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,142 @@
+package scraper
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const postArchiveFilename = "posts.jsonl"
+
+// PostRecord is a single line in the post archive of a blog.
+// Posts may be recorded multiple times (e.g. after a rescrape),
+// in which case the last record of a post ID is the most recent one.
+type PostRecord struct {
+	ID         int64           `json:"id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	Tags       []string        `json:"tags"`
+	SourceBlog string          `json:"source_blog"`
+	Files      []string        `json:"files"`
+	Post       json.RawMessage `json:"post"`
+}
+
+// postArchive appends PostRecords as JSON lines to a file inside the blog's target directory.
+type postArchive struct {
+	lock    sync.Mutex
+	target  string
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openPostArchive(target string) (*postArchive, error) {
+	file, err := os.OpenFile(filepath.Join(target, postArchiveFilename), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &postArchive{
+		target:  target,
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (s *postArchive) Close() error {
+	return s.file.Close()
+}
+
+func (s *postArchive) Write(record *PostRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.encoder.Encode(record)
+}
+
+// readPostArchive returns the most recent record of each post in the blog's archive, newest first.
+func readPostArchive(target string) ([]*PostRecord, error) {
+	file, err := os.Open(filepath.Join(target, postArchiveFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	byID := make(map[int64]*PostRecord)
+	decoder := json.NewDecoder(file)
+
+	for {
+		record := &PostRecord{}
+		err := decoder.Decode(record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		byID[record.ID] = record
+	}
+
+	records := make([]*PostRecord, 0, len(byID))
+	for _, record := range byID {
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Timestamp.Equal(records[j].Timestamp) {
+			return records[i].Timestamp.After(records[j].Timestamp)
+		}
+		return records[i].ID > records[j].ID
+	})
+
+	return records, nil
+}
+
+// archivePostAsync writes the post to the archive as soon as all of its downloads finished.
+// Just like its downloads, the page of the post is only checkpointed once the post has been archived.
+func (sc *scrapeContext) archivePostAsync(post *post) {
+	page := sc.page
+	page.wg.Add(1)
+
+	sc.errgroup.Go(func() error {
+		defer page.wg.Done()
+
+		post.pending.Wait()
+
+		// Failing the page prevents its checkpoint, so that the post
+		// will be scraped and archived again during the next run.
+		if sc.ctx.Err() != nil {
+			atomic.StoreInt32(&page.failed, 1)
+			return nil
+		}
+
+		record := &PostRecord{
+			ID:         post.id,
+			Timestamp:  post.timestamp().UTC(),
+			Tags:       post.Tags,
+			SourceBlog: post.sourceBlogName(),
+			Files:      make([]string, 0, len(post.files)),
+			Post:       post.raw,
+		}
+
+		for _, path := range post.files {
+			rel, err := filepath.Rel(sc.archive.target, path)
+			if err != nil {
+				rel = path
+			}
+			record.Files = append(record.Files, filepath.ToSlash(rel))
+		}
+
+		err := sc.archive.Write(record)
+		if err != nil {
+			atomic.StoreInt32(&page.failed, 1)
+			log.Printf("%s: failed to archive post %d: %v", sc.blogConfig.Name, post.id, err)
+		}
+		return err
+	})
+}
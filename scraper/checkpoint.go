@@ -0,0 +1,78 @@
+package scraper
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+// scrapePage tracks the downloads started for a single page of posts.
+type scrapePage struct {
+	wg     sync.WaitGroup
+	failed int32
+}
+
+// restoreCheckpoint resumes the pagination of a previous, unfinished scrape if
+// it's still within the date range of this one and covered the newer posts in it.
+func (sc *scrapeContext) restoreCheckpoint() error {
+	checkpoint, err := sc.scraper.database.GetCheckpoint(sc.blogConfig.Name)
+	if err != nil || checkpoint == nil {
+		return err
+	}
+
+	if !sc.until.IsZero() {
+		if checkpoint.Before.After(sc.until) || !checkpoint.Before.After(sc.after) || checkpoint.Top.Before(sc.until) {
+			return nil
+		}
+	} else if !checkpoint.Top.IsZero() {
+		sc.top = checkpoint.Top
+	}
+
+	sc.offset = checkpoint.Offset
+	sc.before = checkpoint.Before
+	sc.lowestID = checkpoint.LowestID
+	sc.highestID = checkpoint.HighestID
+	return nil
+}
+
+// checkpointAsync persists the current pagination state once all downloads
+// of the current page and the checkpoints of all previous pages have finished.
+// A page with failed downloads prevents any further checkpoints from being written,
+// so that the next run resumes with the first incomplete page.
+func (sc *scrapeContext) checkpointAsync() {
+	page := sc.page
+	prev := sc.lastCheckpoint
+	done := make(chan struct{})
+	sc.lastCheckpoint = done
+
+	checkpoint := &database.Checkpoint{
+		Offset:    sc.offset,
+		Before:    sc.before,
+		LowestID:  sc.lowestID,
+		HighestID: sc.highestID,
+		Top:       sc.top,
+	}
+
+	go func() {
+		defer close(done)
+
+		page.wg.Wait()
+		if prev != nil {
+			<-prev
+		}
+
+		if atomic.LoadInt32(&page.failed) != 0 {
+			atomic.StoreInt32(&sc.checkpointFailed, 1)
+		}
+		if atomic.LoadInt32(&sc.checkpointFailed) != 0 {
+			return
+		}
+
+		err := sc.scraper.database.SaveCheckpoint(sc.blogConfig.Name, checkpoint)
+		if err != nil {
+			log.Printf("%s: failed to save checkpoint: %v", sc.blogConfig.Name, err)
+		}
+	}()
+}
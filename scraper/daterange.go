@@ -0,0 +1,62 @@
+package scraper
+
+import (
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+// uncoveredRanges returns the parts of the blog's date window which haven't been scraped yet, newest first.
+func (s *Scraper) uncoveredRanges(blogConfig *config.BlogConfig, now time.Time) ([]database.DateRange, error) {
+	window := database.DateRange{To: now}
+	if blogConfig.After != nil {
+		window.From = blogConfig.After.Resolve(now)
+	}
+	if blogConfig.Before != nil {
+		window.To = blogConfig.Before.Resolve(now)
+	}
+	if !window.From.Before(window.To) {
+		return nil, nil
+	}
+
+	if blogConfig.Rescrape {
+		return []database.DateRange{window}, nil
+	}
+
+	coverage, err := s.database.GetCoverage(blogConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return subtractDateRanges(window, coverage), nil
+}
+
+// subtractDateRanges returns the parts of r not contained in the sorted, non-overlapping coverage, newest first.
+func subtractDateRanges(r database.DateRange, coverage []database.DateRange) []database.DateRange {
+	var result []database.DateRange
+	cursor := r.To
+
+	for i := len(coverage) - 1; i >= 0 && cursor.After(r.From); i-- {
+		c := coverage[i]
+		if !c.From.Before(cursor) {
+			continue
+		}
+
+		if c.To.Before(cursor) {
+			from := c.To
+			if from.Before(r.From) {
+				from = r.From
+			}
+			result = append(result, database.DateRange{From: from, To: cursor})
+		}
+
+		cursor = c.From
+	}
+
+	if cursor.After(r.From) {
+		result = append(result, database.DateRange{From: r.From, To: cursor})
+	}
+
+	return result
+}
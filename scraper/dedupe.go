@@ -0,0 +1,224 @@
+package scraper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+// dedupeStore keeps a single copy of every downloaded file in a directory of its own,
+// named after the SHA-256 hash of its contents. The files in the target directories
+// of all blogs are links to these copies, which is why deleting or reorganizing
+// the target directory of one blog doesn't affect any of the others.
+type dedupeStore struct {
+	lock     sync.Mutex
+	database *database.Database
+	dir      string
+	mode     string
+}
+
+func newDedupeStore(cfg *config.Config, db *database.Database) *dedupeStore {
+	dir := cfg.DedupeStore
+	if len(dir) == 0 {
+		dir = filepath.Join(filepath.Dir(db.Path()), "dedupe")
+	}
+
+	mode := cfg.Dedupe
+	if len(mode) == 0 {
+		mode = config.DedupeHardlink
+	}
+
+	return &dedupeStore{
+		database: db,
+		dir:      dir,
+		mode:     mode,
+	}
+}
+
+// lookup returns the stored copy and hash of the file previously downloaded from rawurl.
+func (s *dedupeStore) lookup(rawurl string) (string, string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	hash, err := s.database.GetURLHash(rawurl)
+	if err != nil || len(hash) == 0 {
+		return "", "", false
+	}
+
+	stored, ok := s.stored(hash)
+	return stored, hash, ok
+}
+
+// stored returns the path of the stored copy of the file with the given hash, if there is one.
+func (s *dedupeStore) stored(hash string) (string, bool) {
+	stored, err := s.database.GetMediaPath(hash)
+	if err != nil || len(stored) == 0 {
+		return "", false
+	}
+
+	// Copies outside of the store are ignored, as they were stored before the store was moved elsewhere.
+	if filepath.Dir(filepath.Dir(stored)) != filepath.Clean(s.dir) {
+		return "", false
+	}
+
+	_, err = os.Stat(stored)
+	if err != nil {
+		return "", false
+	}
+
+	return stored, true
+}
+
+// add registers the file at path with the given hash.
+// If the store already holds a copy of it, path is replaced with a link to it and true is returned.
+// Otherwise the file becomes the stored copy, which path is linked to.
+func (s *dedupeStore) add(rawurl string, hash string, path string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(rawurl) != 0 {
+		err := s.database.SetURLHash(rawurl, hash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if stored, ok := s.stored(hash); ok {
+		storedInfo, err := os.Stat(stored)
+		if err != nil {
+			return false, err
+		}
+		if os.SameFile(storedInfo, info) {
+			return false, nil
+		}
+		return true, s.link(stored, path)
+	}
+
+	// The store is sharded by the first two characters of the hash,
+	// so that no single directory has to hold all files.
+	stored := filepath.Join(s.dir, hash[:2], hash+filepath.Ext(path))
+	err = os.MkdirAll(filepath.Dir(stored), 0755)
+	if err != nil {
+		return false, err
+	}
+
+	_ = os.Remove(stored)
+	if s.mode == config.DedupeSymlink {
+		err = os.Rename(path, stored)
+		if err == nil {
+			err = s.link(stored, path)
+			if err != nil {
+				_ = os.Rename(stored, path)
+			}
+		}
+	} else {
+		err = os.Link(path, stored)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return false, s.database.SetMediaPath(hash, stored)
+}
+
+// link atomically replaces path with a link to the stored copy.
+func (s *dedupeStore) link(stored string, path string) error {
+	tmpPath := path + ".link"
+	_ = os.Remove(tmpPath)
+
+	var err error
+	if s.mode == config.DedupeSymlink {
+		// Absolute targets keep working if the target directory is moved.
+		var target string
+		target, err = filepath.Abs(stored)
+		if err == nil {
+			err = os.Symlink(target, tmpPath)
+		}
+	} else {
+		err = os.Link(stored, tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	h := sha256.New()
+	err := hashFileInto(h, path)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFileInto(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// Dedupe moves the files in the target directories of all blogs into the store
+// and replaces them with links, collapsing files with identical contents.
+func Dedupe(ctx context.Context, cfg *config.Config, db *database.Database) error {
+	s := newDedupeStore(cfg, db)
+
+	for _, blog := range cfg.Blogs {
+		err := filepath.Walk(blog.Target, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !info.Mode().IsRegular() || info.Name() == postArchiveFilename || filepath.Ext(path) == partExtension {
+				return nil
+			}
+
+			hash, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+
+			linked, err := s.add("", hash, path)
+			if err != nil {
+				log.Printf("%s: failed to dedupe %s: %v", blog.Name, path, err)
+			} else if linked {
+				log.Printf("%s: linked %s", blog.Name, path)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
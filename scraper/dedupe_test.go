@@ -0,0 +1,69 @@
+package scraper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+func TestDedupeSurvivesRemovedBlog(t *testing.T) {
+	for _, mode := range []string{config.DedupeHardlink, config.DedupeSymlink} {
+		t.Run(mode, func(t *testing.T) {
+			env := newTestEnv(t)
+			defer env.Close()
+
+			env.config.Dedupe = mode
+			env.scraper = NewScraper(env.scraper.client, env.config, env.db)
+
+			// Both blogs post the same photos.
+			env.addPhotoPosts(false, 1, 3)
+			other := &config.BlogConfig{
+				Name:   "other.tumblr.com",
+				Target: filepath.Join(env.dir, "other"),
+			}
+			env.config.Blogs = append(env.config.Blogs, other)
+			env.server.AddBlog(other.Name, false, env.photoPost(1, nil), env.photoPost(2, nil), env.photoPost(3, nil))
+
+			env.update()
+			_, err := env.scraper.Scrape(context.Background(), other)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(other.Target, "photo1.jpg")
+			record, err := env.db.GetFileRecord(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record == nil || record.Blog != other.Name || record.Size != int64(len("photo 1")) {
+				t.Fatalf("linked file has record %+v", record)
+			}
+
+			broken, err := Verify(context.Background(), env.config, env.db, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if broken != 0 {
+				t.Errorf("%d files are broken", broken)
+			}
+
+			// The files of the other blog must not depend on the ones of the first blog.
+			err = os.RemoveAll(env.blog.Target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "photo 1" {
+				t.Errorf("linked file contains %q", data)
+			}
+		})
+	}
+}
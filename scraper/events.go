@@ -0,0 +1,95 @@
+package scraper
+
+import (
+	"sync/atomic"
+
+	"github.com/lhecker/tumblr-scraper/events"
+)
+
+// SetEventSink makes the scraper report its progress to sink.
+// It must be called before scraping any blogs.
+func (s *Scraper) SetEventSink(sink events.Sink) {
+	s.events = sink
+}
+
+func (s *Scraper) emit(e *events.Event) {
+	if s.events != nil {
+		s.events.Emit(e)
+	}
+}
+
+func (sc *scrapeContext) emit(e *events.Event) {
+	e.Blog = sc.blogConfig.Name
+	sc.scraper.emit(e)
+}
+
+// QueueStats returns the number of requests of the blog waiting for and holding a slot of the shared concurrency limit.
+func (s *Scraper) QueueStats(blogName string) (queued int, active int) {
+	return s.sema.Stats(blogName)
+}
+
+func (sc *scrapeContext) pageFetched(res *postsResponse) {
+	page := atomic.AddInt64(&sc.stats.Pages, 1)
+	sc.emit(&events.Event{
+		Type:       events.PageFetched,
+		Page:       int(page),
+		Posts:      len(res.Response.Posts),
+		TotalPosts: res.Response.TotalPosts,
+	})
+}
+
+func (sc *scrapeContext) postScraped(post *post) {
+	atomic.AddInt64(&sc.stats.Posts, 1)
+	sc.emit(&events.Event{
+		Type:    events.PostScraped,
+		PostID:  post.id,
+		Files:   post.mediaCount,
+		Skipped: post.skipped,
+	})
+}
+
+func (sc *scrapeContext) fileWritten(post *post, rawurl string, path string, size int64, linked bool) {
+	atomic.AddInt64(&sc.stats.FilesWritten, 1)
+	atomic.AddInt64(&sc.stats.Bytes, size)
+	sc.emit(&events.Event{
+		Type:   events.FileWritten,
+		PostID: post.id,
+		URL:    rawurl,
+		Path:   path,
+		Bytes:  size,
+		Linked: linked,
+	})
+}
+
+func (sc *scrapeContext) fileSkipped(post *post, rawurl string, path string) {
+	atomic.AddInt64(&sc.stats.FilesSkipped, 1)
+	sc.emit(&events.Event{
+		Type:   events.FileSkipped,
+		PostID: post.id,
+		URL:    rawurl,
+		Path:   path,
+	})
+}
+
+func (sc *scrapeContext) fileFailed(post *post, rawurl string, attempts int, err error) {
+	atomic.AddInt64(&sc.stats.FilesFailed, 1)
+	sc.emit(&events.Event{
+		Type:     events.FileFailed,
+		PostID:   post.id,
+		URL:      rawurl,
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+}
+
+// loadStats returns a copy of the statistics which is safe to read while downloads are still running.
+func (sc *scrapeContext) loadStats() events.Stats {
+	return events.Stats{
+		Pages:        atomic.LoadInt64(&sc.stats.Pages),
+		Posts:        atomic.LoadInt64(&sc.stats.Posts),
+		FilesWritten: atomic.LoadInt64(&sc.stats.FilesWritten),
+		FilesSkipped: atomic.LoadInt64(&sc.stats.FilesSkipped),
+		FilesFailed:  atomic.LoadInt64(&sc.stats.FilesFailed),
+		Bytes:        atomic.LoadInt64(&sc.stats.Bytes),
+	}
+}
@@ -0,0 +1,563 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+// Text and answer posts are exported into this directory inside the blog's target directory.
+const exportDirectory = "posts"
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"[", `\[`,
+	"]", `\]`,
+	"<", `\<`,
+	"#", `\#`,
+)
+
+// Escapes the characters which would end a Markdown link destination early.
+var markdownURLEscaper = strings.NewReplacer(
+	" ", "%20",
+	"(", "%28",
+	")", "%29",
+	"<", "%3C",
+	">", "%3E",
+)
+
+// Elements of legacy posts which are dropped when rendering them, since they can run scripts or load other documents.
+var unsafeElements = map[string]struct{}{
+	"applet":   {},
+	"base":     {},
+	"embed":    {},
+	"frame":    {},
+	"frameset": {},
+	"iframe":   {},
+	"link":     {},
+	"math":     {},
+	"meta":     {},
+	"object":   {},
+	"script":   {},
+	"style":    {},
+	"svg":      {},
+}
+
+// exportPostAsync writes text and answer posts as standalone documents as soon as all of their downloads finished.
+// Just like its downloads, the page of the post is only checkpointed once the post has been exported.
+func (sc *scrapeContext) exportPostAsync(post *post) {
+	switch post.postType() {
+	case "text", "answer":
+	default:
+		return
+	}
+
+	page := sc.page
+	page.wg.Add(1)
+
+	sc.errgroup.Go(func() error {
+		defer page.wg.Done()
+
+		post.pending.Wait()
+
+		// Failing the page prevents its checkpoint, so that the post
+		// will be scraped and exported again during the next run.
+		if sc.ctx.Err() != nil {
+			atomic.StoreInt32(&page.failed, 1)
+			return nil
+		}
+
+		err := sc.exportPost(post)
+		if err != nil {
+			atomic.StoreInt32(&page.failed, 1)
+			log.Printf("%s: failed to export post %d: %v", sc.blogConfig.Name, post.id, err)
+		}
+		return err
+	})
+}
+
+func (sc *scrapeContext) exportPost(post *post) error {
+	dir := filepath.Join(sc.blogConfig.Target, exportDirectory)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	r := &postRenderer{
+		markdown: sc.blogConfig.ExportPosts == config.ExportMarkdown,
+		resolve: func(rawurl string) string {
+			path, ok := post.localFile(rawurl)
+			if !ok {
+				path, ok = post.localFile(fixupURL(rawurl))
+			}
+			if !ok {
+				return rawurl
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return rawurl
+			}
+			return (&url.URL{Path: filepath.ToSlash(rel)}).String()
+		},
+	}
+
+	data, err := r.render(post)
+	if err != nil {
+		return err
+	}
+
+	ext := ".html"
+	if r.markdown {
+		ext = ".md"
+	}
+
+	path := filepath.Join(dir, strconv.FormatInt(post.id, 10)+ext)
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s: exported %s", sc.blogConfig.Name, path)
+	return nil
+}
+
+// postRenderer renders a post including its trail as either Markdown or HTML.
+type postRenderer struct {
+	buf      bytes.Buffer
+	markdown bool
+
+	// Returns the URL the document should use to refer to the media file at rawurl.
+	resolve func(rawurl string) string
+
+	// Type of the HTML list which is currently open, if any.
+	list string
+}
+
+func (r *postRenderer) render(post *post) ([]byte, error) {
+	title := post.Title
+	if len(title) == 0 {
+		title = fmt.Sprintf("%s - post %d", post.BlogName, post.id)
+	}
+
+	date := post.timestamp().UTC().Format("2006-01-02 15:04:05 MST")
+	tags := make([]string, len(post.Tags))
+	for i, tag := range post.Tags {
+		tags[i] = "#" + tag
+	}
+
+	if r.markdown {
+		fmt.Fprintf(&r.buf, "# %s\n\n%s", r.escape(title), date)
+		if len(tags) != 0 {
+			fmt.Fprintf(&r.buf, " · %s", r.escape(strings.Join(tags, " ")))
+		}
+		r.buf.WriteString("\n\n")
+	} else {
+		fmt.Fprintf(&r.buf, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n<article>\n", html.EscapeString(title))
+		fmt.Fprintf(&r.buf, "<h1>%s</h1>\n<p><time>%s</time>", html.EscapeString(title), date)
+		if len(tags) != 0 {
+			fmt.Fprintf(&r.buf, " · %s", html.EscapeString(strings.Join(tags, " ")))
+		}
+		r.buf.WriteString("</p>\n")
+	}
+
+	err := r.content(post)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.markdown {
+		r.buf.WriteString("</article>\n</body>\n</html>\n")
+	}
+
+	return r.buf.Bytes(), nil
+}
+
+// content renders the text of the post and its trail without any header.
+func (r *postRenderer) content(post *post) error {
+	if len(post.Question) != 0 {
+		asker := post.AskingName
+		if len(asker) == 0 {
+			asker = "Anonymous"
+		}
+		r.section(asker + " asked")
+		r.fragment(post.Question)
+		r.endSection()
+	}
+
+	isNpf := len(post.Content) != 0 || post.Type == "blocks"
+
+	for _, t := range post.Trail {
+		name := t.BrokenBlogName
+		if len(t.Blog.Name) != 0 {
+			name = t.Blog.Name
+		}
+
+		// Content is either NPF or an HTML string.
+		r.section(name)
+		var cs []content
+		if json.Unmarshal(t.Content, &cs) == nil {
+			err := r.npf(cs, t.Layout)
+			if err != nil {
+				return err
+			}
+		} else {
+			text := t.ContentRaw
+			if len(text) == 0 {
+				_ = json.Unmarshal(t.Content, &text)
+			}
+			r.fragment(text)
+		}
+		r.endSection()
+	}
+
+	if isNpf {
+		if len(post.Content) != 0 {
+			r.section(post.BlogName)
+			err := r.npf(post.Content, post.Layout)
+			if err != nil {
+				return err
+			}
+			r.endSection()
+		}
+	} else if len(post.Trail) == 0 {
+		// Without a trail the body already contains the entire post.
+		for _, text := range []string{post.Body, post.Answer} {
+			if len(text) != 0 {
+				r.section(post.BlogName)
+				r.fragment(text)
+				r.endSection()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *postRenderer) section(name string) {
+	if !r.markdown {
+		r.buf.WriteString("<section>\n")
+	}
+	if len(name) == 0 {
+		return
+	}
+
+	if r.markdown {
+		fmt.Fprintf(&r.buf, "## %s\n\n", r.escape(name))
+	} else {
+		fmt.Fprintf(&r.buf, "<h2>%s</h2>\n", html.EscapeString(name))
+	}
+}
+
+func (r *postRenderer) endSection() {
+	if !r.markdown {
+		r.closeList()
+		r.buf.WriteString("</section>\n")
+	}
+}
+
+// npf renders NPF content blocks: https://www.tumblr.com/docs/npf
+func (r *postRenderer) npf(cs []content, ls []layout) error {
+	// Blocks belonging to an ask are rendered as a quote.
+	asks := make(map[int]string)
+	for _, l := range ls {
+		if l.Type != "ask" {
+			continue
+		}
+		asker := l.Attribution.Blog.Name
+		if len(asker) == 0 {
+			asker = "Anonymous"
+		}
+		for _, i := range l.Blocks {
+			asks[i] = asker
+		}
+	}
+
+	for i, c := range cs {
+		if asker, ok := asks[i]; ok && (i == 0 || asks[i-1] != asker) {
+			r.text(asker+" asked:", "")
+		}
+
+		subtype := c.Subtype
+		if _, ok := asks[i]; ok {
+			subtype = "quote"
+		}
+
+		err := r.block(c, subtype)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *postRenderer) block(c content, subtype string) error {
+	switch c.Type {
+	case "text":
+		r.text(c.Text, subtype)
+	case "link":
+		title := c.Title
+		if len(title) == 0 {
+			title = c.URL
+		}
+		if !isSafeURL(c.URL) {
+			r.text(title, "")
+			return nil
+		}
+
+		r.closeList()
+		if r.markdown {
+			fmt.Fprintf(&r.buf, "[%s](%s)\n\n", r.escape(title), r.escapeURL(c.URL))
+		} else {
+			fmt.Fprintf(&r.buf, "<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(c.URL), html.EscapeString(title))
+		}
+	case "image":
+		var ms imageMedia
+		err := json.Unmarshal(c.Media, &ms)
+		if err != nil {
+			return err
+		}
+		if len(ms) == 0 {
+			return nil
+		}
+
+		src := r.resolve(ms.best().URL)
+		if !isSafeURL(src) {
+			return nil
+		}
+
+		r.closeList()
+		if r.markdown {
+			fmt.Fprintf(&r.buf, "![](%s)\n\n", r.escapeURL(src))
+		} else {
+			fmt.Fprintf(&r.buf, "<p><img src=\"%s\"></p>\n", html.EscapeString(src))
+		}
+	case "video", "audio":
+		var m videoMedia
+		if len(c.Media) != 0 {
+			err := json.Unmarshal(c.Media, &m)
+			if err != nil {
+				return err
+			}
+		}
+		if len(m.URL) == 0 {
+			m.URL = c.URL
+		}
+		if len(m.URL) == 0 {
+			return nil
+		}
+
+		src := r.resolve(m.URL)
+		if !isSafeURL(src) {
+			return nil
+		}
+
+		r.closeList()
+		if r.markdown {
+			fmt.Fprintf(&r.buf, "[%s](%s)\n\n", c.Type, r.escapeURL(src))
+		} else {
+			fmt.Fprintf(&r.buf, "<p><%s controls src=\"%s\"></%s></p>\n", c.Type, html.EscapeString(src), c.Type)
+		}
+	}
+
+	return nil
+}
+
+func (r *postRenderer) text(text string, subtype string) {
+	if r.markdown {
+		lines := strings.Split(r.escape(text), "\n")
+
+		prefix := ""
+		switch subtype {
+		case "heading1":
+			prefix = "### "
+		case "heading2":
+			prefix = "#### "
+		case "quote", "indented":
+			prefix = "> "
+		case "ordered-list-item":
+			prefix = "1. "
+		case "unordered-list-item":
+			prefix = "- "
+		}
+
+		r.buf.WriteString(prefix)
+		r.buf.WriteString(strings.Join(lines, "  \n"+strings.Repeat(" ", len(prefix))))
+		r.buf.WriteString("\n\n")
+		return
+	}
+
+	text = strings.Replace(html.EscapeString(text), "\n", "<br>", -1)
+
+	switch subtype {
+	case "ordered-list-item", "unordered-list-item":
+		list := "ul"
+		if subtype == "ordered-list-item" {
+			list = "ol"
+		}
+		if r.list != list {
+			r.closeList()
+			fmt.Fprintf(&r.buf, "<%s>\n", list)
+			r.list = list
+		}
+		fmt.Fprintf(&r.buf, "<li>%s</li>\n", text)
+		return
+	}
+
+	r.closeList()
+
+	switch subtype {
+	case "heading1":
+		fmt.Fprintf(&r.buf, "<h3>%s</h3>\n", text)
+	case "heading2":
+		fmt.Fprintf(&r.buf, "<h4>%s</h4>\n", text)
+	case "quote", "indented":
+		fmt.Fprintf(&r.buf, "<blockquote>%s</blockquote>\n", text)
+	default:
+		fmt.Fprintf(&r.buf, "<p>%s</p>\n", text)
+	}
+}
+
+func (r *postRenderer) closeList() {
+	if len(r.list) != 0 {
+		fmt.Fprintf(&r.buf, "</%s>\n", r.list)
+		r.list = ""
+	}
+}
+
+// fragment writes an HTML fragment of a legacy post with its media references resolved.
+// Markdown allows inline HTML, which is why fragments are written as is in both formats.
+// Anything that could run scripts is removed first, see sanitizeNode.
+func (r *postRenderer) fragment(text string) {
+	r.closeList()
+
+	context := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Div,
+		Data:     "div",
+	}
+
+	nodes, err := html.ParseFragment(strings.NewReader(text), context)
+	if err != nil {
+		r.buf.WriteString(html.EscapeString(text))
+		r.buf.WriteString("\n\n")
+		return
+	}
+
+	for _, node := range nodes {
+		if !sanitizeNode(node) {
+			continue
+		}
+		r.resolveNode(node)
+		_ = html.Render(&r.buf, node)
+	}
+	r.buf.WriteString("\n\n")
+}
+
+func (r *postRenderer) resolveNode(node *html.Node) {
+	if node.Type == html.ElementNode {
+		for i, attr := range node.Attr {
+			switch attr.Key {
+			case "href", "src", "data-big-photo":
+				if mediaURLRegexp.MatchString(attr.Val) {
+					node.Attr[i].Val = r.resolve(attr.Val)
+				}
+			}
+		}
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		r.resolveNode(child)
+	}
+}
+
+func (r *postRenderer) escape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+func (r *postRenderer) escapeURL(rawurl string) string {
+	return markdownURLEscaper.Replace(rawurl)
+}
+
+// sanitizeNode removes unsafe elements, event handler attributes (e.g. onclick)
+// and URLs with schemes other than http and https (e.g. javascript:) from node and its descendants.
+// It returns false if node itself is unsafe and must be dropped.
+func sanitizeNode(node *html.Node) bool {
+	if node.Type == html.ElementNode {
+		if _, ok := unsafeElements[strings.ToLower(node.Data)]; ok {
+			return false
+		}
+
+		attrs := node.Attr[:0]
+		for _, attr := range node.Attr {
+			if isSafeAttribute(attr) {
+				attrs = append(attrs, attr)
+			}
+		}
+		node.Attr = attrs
+	}
+
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if !sanitizeNode(child) {
+			node.RemoveChild(child)
+		}
+		child = next
+	}
+
+	return true
+}
+
+func isSafeAttribute(attr html.Attribute) bool {
+	key := strings.ToLower(attr.Key)
+	if strings.HasPrefix(key, "on") {
+		return false
+	}
+
+	switch key {
+	case "href", "src", "data-big-photo", "action", "formaction", "poster", "background", "cite":
+		return isSafeURL(attr.Val)
+	case "srcset":
+		// A comma separated list of URLs, each optionally followed by a size.
+		for _, candidate := range strings.Split(attr.Val, ",") {
+			fields := strings.Fields(candidate)
+			if len(fields) != 0 && !isSafeURL(fields[0]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isSafeURL returns true for http(s) URLs and relative ones, like those of downloaded files.
+func isSafeURL(rawurl string) bool {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+		return true
+	default:
+		return false
+	}
+}
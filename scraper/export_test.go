@@ -0,0 +1,58 @@
+package scraper
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestRenderer(markdown bool) *postRenderer {
+	return &postRenderer{
+		markdown: markdown,
+		resolve:  func(rawurl string) string { return rawurl },
+	}
+}
+
+func TestPostRendererFragmentSanitizes(t *testing.T) {
+	r := newTestRenderer(false)
+	r.fragment(`<p onclick="alert(1)">text<script>alert(2)</script></p>` +
+		`<iframe src="https://example.com"></iframe><object data="x.swf"></object>` +
+		`<a href="javascript:alert(3)">link</a><a href=" JavaScript:alert(4)">link</a>` +
+		`<img src="data:image/png;base64,AAAA" srcset="https://example.com/a.png 1x, javascript:alert(5) 2x">` +
+		`<svg><script>alert(6)</script></svg><a href="https://example.com/?a=1&amp;b=2">ok</a>`)
+	out := r.buf.String()
+
+	for _, s := range []string{"alert", "<script", "<iframe", "<object", "<svg", "onclick", "javascript", "data:", "srcset"} {
+		if strings.Contains(strings.ToLower(out), strings.ToLower(s)) {
+			t.Errorf("output contains %q: %s", s, out)
+		}
+	}
+	for _, s := range []string{"<p>text</p>", `<a href="https://example.com/?a=1&amp;b=2">ok</a>`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("output is missing %q: %s", s, out)
+		}
+	}
+}
+
+func TestPostRendererLinks(t *testing.T) {
+	link := content{Type: "link", URL: "https://example.com/a (b).html", Title: "title"}
+
+	r := newTestRenderer(true)
+	err := r.block(link, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, expected := r.buf.String(), "[title](https://example.com/a%20%28b%29.html)\n\n"; out != expected {
+		t.Errorf("rendered %q, expected %q", out, expected)
+	}
+
+	for _, markdown := range []bool{true, false} {
+		r := newTestRenderer(markdown)
+		err := r.block(content{Type: "link", URL: "javascript:alert(1)", Title: "title"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := r.buf.String(); strings.Contains(out, "javascript") || !strings.Contains(out, "title") {
+			t.Errorf("rendered %q, expected only the title", out)
+		}
+	}
+}
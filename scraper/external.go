@@ -0,0 +1,152 @@
+package scraper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+var errNoExternalDownloader = errors.New("no external downloader configured")
+
+// externalDownloadAsync downloads a video embedded from another site (e.g. YouTube)
+// using the external downloader, if one is configured.
+func (sc *scrapeContext) externalDownloadAsync(post *post, rawurl string) {
+	index := post.mediaIndex
+	post.mediaIndex++
+
+	if sc.scraper.config.ExternalDownloader == nil || !sc.isMediaTypeAllowed(mediaTypeVideo) {
+		return
+	}
+
+	page := sc.page
+	page.wg.Add(1)
+	post.pending.Add(1)
+
+	post.mediaCount++
+
+	sc.sema.Acquire(sc.offset)
+	sc.errgroup.Go(func() error {
+		defer sc.sema.Release()
+
+		err := sc.externalDownload(post, index, rawurl)
+		if err != nil {
+			atomic.StoreInt32(&page.failed, 1)
+		}
+		post.pending.Done()
+		page.wg.Done()
+		return err
+	})
+}
+
+func (sc *scrapeContext) externalDownload(post *post, index int, rawurl string) error {
+	attempts, err := sc.externalDownloadWithRetries(post, index, rawurl)
+	if err != nil {
+		log.Printf("%s: failed to download %s: %v", sc.blogConfig.Name, rawurl, err)
+
+		if sc.ctx.Err() == nil {
+			sc.fileFailed(post, rawurl, attempts, err)
+			failed := newFailedDownload(sc.blogConfig.Name, post, index, rawurl, attempts, err)
+			failed.External = true
+			err = sc.scraper.database.AddFailedDownload(failed)
+		}
+	}
+	return err
+}
+
+func (sc *scrapeContext) externalDownloadWithRetries(post *post, index int, rawurl string) (int, error) {
+	db := sc.scraper.database
+
+	download, err := db.GetExternalDownload(sc.blogConfig.Name, rawurl)
+	if err != nil {
+		return 0, err
+	}
+	if download != nil {
+		log.Printf("%s: skipping %s", sc.blogConfig.Name, rawurl)
+		post.addFile(rawurl, download.Output)
+		sc.fileSkipped(post, rawurl, download.Output)
+		return 0, nil
+	}
+
+	// The name and extension are filled in by the external downloader.
+	vars := newFilenameVars(post, index, rawurl)
+	vars.name = "%(id)s"
+	vars.ext = ".%(ext)s"
+	template := sc.filepath(vars)
+
+	var path string
+	attempts, err := sc.scraper.retry.do(sc.ctx, func() error {
+		var err error
+		path, err = sc.runExternalDownloader(template, rawurl)
+		return err
+	})
+	if err != nil {
+		return attempts, err
+	}
+
+	log.Printf("%s: wrote %s", sc.blogConfig.Name, path)
+	post.addFile(rawurl, path)
+	sc.fileWritten(post, rawurl, path, fileSize(path), false)
+
+	return attempts, db.SetExternalDownload(&database.ExternalDownload{
+		Blog:         sc.blogConfig.Name,
+		PostID:       post.id,
+		URL:          rawurl,
+		Output:       path,
+		DownloadedAt: time.Now(),
+	})
+}
+
+// runExternalDownloader downloads rawurl using the output template and returns the path of the written file.
+// The path is only known after the download, since the template refers to fields like the video's ID and extension.
+func (sc *scrapeContext) runExternalDownloader(template string, rawurl string) (string, error) {
+	cfg := sc.scraper.config.ExternalDownloader
+	if cfg == nil {
+		return "", errNoExternalDownloader
+	}
+
+	args := append([]string(nil), cfg.Args...)
+	args = append(args, "--print", "after_move:filepath", "-o", template, "--", rawurl)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(sc.ctx, cfg.Command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		// The last line usually contains the actual error message.
+		out := stderr.Bytes()
+		if len(bytes.TrimSpace(out)) == 0 {
+			out = stdout.Bytes()
+		}
+		return "", fmt.Errorf("%s: %v: %s", cfg.Command, err, lastLine(out))
+	}
+
+	path := lastLine(stdout.Bytes())
+	if len(path) == 0 {
+		return "", fmt.Errorf("%s: missing path of the downloaded file", cfg.Command)
+	}
+
+	return path, nil
+}
+
+func lastLine(data []byte) string {
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	return string(bytes.TrimSpace(lines[len(lines)-1]))
+}
+
+// fileSize returns the size of the file at path or 0 if it can't be determined.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
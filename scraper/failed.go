@@ -0,0 +1,107 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+func newFailedDownload(blogName string, post *post, index int, rawurl string, attempts int, err error) *database.FailedDownload {
+	return &database.FailedDownload{
+		Blog:     blogName,
+		PostID:   post.id,
+		URL:      rawurl,
+		Error:    err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+		Index:    index,
+		Post:     post.raw,
+	}
+}
+
+// RetryFailed re-attempts all downloads recorded as failed, without scraping the blogs again.
+// Successful downloads are removed from the database.
+func (s *Scraper) RetryFailed(ctx context.Context) (err error) {
+	failed, err := s.database.GetFailedDownloads()
+	if err != nil {
+		return err
+	}
+
+	blogConfigs := make(map[string]*config.BlogConfig, len(s.config.Blogs))
+	for _, blogConfig := range s.config.Blogs {
+		blogConfigs[blogConfig.Name] = blogConfig
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	contexts := make(map[string]*scrapeContext)
+
+	defer func() {
+		e := eg.Wait()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	for _, fd := range failed {
+		blogConfig := blogConfigs[fd.Blog]
+		if blogConfig == nil {
+			log.Printf("%s: skipping %s - blog is not configured", fd.Blog, fd.URL)
+			continue
+		}
+
+		sc := contexts[fd.Blog]
+		if sc == nil {
+			sc, err = newScrapeContext(s, blogConfig, eg, ctx)
+			if err != nil {
+				return err
+			}
+			contexts[fd.Blog] = sc
+		}
+
+		p := &post{}
+		if len(fd.Post) != 0 {
+			err = json.Unmarshal(fd.Post, p)
+			if err != nil {
+				return err
+			}
+		}
+		p.id = fd.PostID
+		if len(fd.Path) != 0 {
+			p.fixedPath = fd.Path
+			p.Timestamp = fd.FileTime.Unix()
+		}
+
+		fd := fd
+		sc.sema.Acquire(0)
+		eg.Go(func() error {
+			defer sc.sema.Release()
+
+			download := sc.downloadFileWithRetries
+			if fd.External {
+				download = sc.externalDownloadWithRetries
+			}
+
+			attempts, err := download(p, fd.Index, fd.URL)
+			if err == nil {
+				return s.database.DeleteFailedDownload(fd.Blog, fd.URL)
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+
+			log.Printf("%s: failed to download file: %v", fd.Blog, err)
+			sc.fileFailed(p, fd.URL, attempts, err)
+			failed := newFailedDownload(fd.Blog, p, fd.Index, fd.URL, attempts, err)
+			failed.External = fd.External
+			return s.database.AddFailedDownload(failed)
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package scraper
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+// The default template results in the same filename Tumblr uses for its media URLs.
+const defaultFilenameTemplate = "{name}{ext}"
+
+// filenameVars contains the values for the placeholders of a BlogConfig.FilenameTemplate.
+//
+// Available placeholders are:
+//
+//	{blog}           name of the scraped blog
+//	{post_id}        ID of the post
+//	{index}          zero-based index of the file among all media of the post, regardless of any filters
+//	{year}, {month}, {day}
+//	                 UTC date the post was published at
+//	{root_blog}      name of the blog the post originally stems from
+//	{reblogged_from} name of the blog the post was reblogged from (empty for non-reblogs)
+//	{name}, {ext}    filename of the media URL, split into its basename and extension
+type filenameVars struct {
+	post  *post
+	index int
+	name  string
+	ext   string
+}
+
+func newFilenameVars(post *post, index int, rawurl string) *filenameVars {
+	file := filepath.Base(rawurl)
+	ext := filepath.Ext(file)
+
+	return &filenameVars{
+		post:  post,
+		index: index,
+		name:  strings.TrimSuffix(file, ext),
+		ext:   ext,
+	}
+}
+
+func (sc *scrapeContext) filepath(vars *filenameVars) string {
+	if len(vars.post.fixedPath) != 0 {
+		return vars.post.fixedPath
+	}
+
+	template := sc.blogConfig.FilenameTemplate
+	if len(template) == 0 {
+		template = defaultFilenameTemplate
+	}
+
+	blog := config.TumblrDomainToName(sc.blogConfig.Name)
+	rootBlog := vars.post.sourceBlogName()
+	if len(rootBlog) == 0 {
+		rootBlog = blog
+	}
+
+	t := vars.post.timestamp().UTC()
+
+	replacer := strings.NewReplacer(
+		"{blog}", blog,
+		"{post_id}", strconv.FormatInt(vars.post.id, 10),
+		"{index}", strconv.Itoa(vars.index),
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{root_blog}", rootBlog,
+		"{reblogged_from}", vars.post.RebloggedFromName,
+		"{name}", vars.name,
+		"{ext}", vars.ext,
+	)
+
+	return filepath.Join(sc.blogConfig.Target, filepath.FromSlash(replacer.Replace(template)))
+}
@@ -0,0 +1,120 @@
+package scraper
+
+import (
+	"path"
+	"strings"
+)
+
+const (
+	mediaTypeImage = "image"
+	mediaTypeGIF   = "gif"
+	mediaTypeVideo = "video"
+	mediaTypeAudio = "audio"
+)
+
+// Returns the type of the post as one of
+// "text", "photo", "quote", "link", "chat", "audio", "video" or "answer".
+func (s *post) postType() string {
+	t := s.Type
+	if t == "blocks" {
+		// NPF posts contain the legacy type in .OriginalType
+		t = s.OriginalType
+	}
+
+	switch t {
+	case "regular":
+		return "text"
+	case "conversation":
+		return "chat"
+	case "note":
+		return "answer"
+	case "", "blocks":
+		return s.npfPostType()
+	}
+
+	return t
+}
+
+// Guesses the type of an NPF post based on its content.
+func (s *post) npfPostType() string {
+	for _, l := range s.Layout {
+		if l.Type == "ask" {
+			return "answer"
+		}
+	}
+
+	t := "text"
+	for _, c := range s.Content {
+		switch c.Type {
+		case "video", "audio":
+			return c.Type
+		case "image":
+			t = "photo"
+		}
+	}
+	return t
+}
+
+// Returns true if the post type is allowed by the blog's config.
+func (sc *scrapeContext) handlePostType(post *post) bool {
+	if len(sc.blogConfig.PostTypes) == 0 {
+		return true
+	}
+
+	t := post.postType()
+	for _, allowed := range sc.blogConfig.PostTypes {
+		if strings.EqualFold(allowed, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the media type of the file at rawurl based on its extension.
+func mediaTypeOf(rawurl string) string {
+	switch strings.ToLower(path.Ext(rawurl)) {
+	case ".gif", ".gifv":
+		return mediaTypeGIF
+	case ".mp4", ".mov", ".webm":
+		return mediaTypeVideo
+	case ".mp3", ".m4a", ".ogg", ".oga", ".wav", ".aac", ".flac":
+		return mediaTypeAudio
+	}
+	// Legacy audio posts link to URLs like https://www.tumblr.com/audio_file/{blog}/{post_id}/tumblr_{id}
+	if strings.Contains(rawurl, "/audio_file/") {
+		return mediaTypeAudio
+	}
+	return mediaTypeImage
+}
+
+// Returns true if the media type and resolution are allowed by the blog's config.
+// A width or height of 0 means that the resolution is unknown, which always passes.
+func (sc *scrapeContext) isMediaAllowed(rawurl string, width, height int) bool {
+	if (width != 0 && width < sc.blogConfig.MinWidth) || (height != 0 && height < sc.blogConfig.MinHeight) {
+		return false
+	}
+
+	return sc.isMediaTypeAllowed(mediaTypeOf(rawurl))
+}
+
+func (sc *scrapeContext) isMediaTypeAllowed(t string) bool {
+	if len(sc.blogConfig.MediaTypes) == 0 {
+		return true
+	}
+
+	for _, allowed := range sc.blogConfig.MediaTypes {
+		if strings.EqualFold(allowed, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *scrapeContext) downloadMediaAsync(post *post, rawurl string, width, height int) {
+	index := post.mediaIndex
+	post.mediaIndex++
+
+	if sc.isMediaAllowed(rawurl, width, height) {
+		sc.downloadFileAsync(post, index, rawurl)
+	}
+}
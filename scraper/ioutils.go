@@ -1,9 +1,19 @@
 package scraper
 
 import (
+	"context"
+	"errors"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Media downloads are aborted if a read from the response body takes longer than this.
+const mediaIdleTimeout = 60 * time.Second
+
+var errIdleTimeout = errors.New("no data received within the idle timeout")
+
 var (
 	lockedFilesMutex sync.Mutex
 	lockedFiles      = make(map[string]struct{})
@@ -27,3 +37,33 @@ func releaseFile(path string) {
 
 	delete(lockedFiles, path)
 }
+
+// idleTimeoutReader calls cancel and fails with errIdleTimeout if a single Read takes longer than timeout.
+// cancel is supposed to cancel the context of the request r belongs to, which aborts the pending Read.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	ir := &idleTimeoutReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&ir.expired, 1)
+		cancel()
+	})
+	ir.timer.Stop()
+	return ir
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.r.Read(p)
+	r.timer.Stop()
+
+	if err != nil && atomic.LoadInt32(&r.expired) != 0 {
+		err = errIdleTimeout
+	}
+	return n, err
+}
@@ -0,0 +1,27 @@
+package scraper
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestIdleTimeoutReader(t *testing.T) {
+	pr, pw := io.Pipe()
+	cancel := func() { _ = pw.CloseWithError(errors.New("canceled")) }
+
+	go func() {
+		_, _ = pw.Write([]byte("data"))
+		// Stall without closing the pipe.
+	}()
+
+	data, err := ioutil.ReadAll(newIdleTimeoutReader(pr, 50*time.Millisecond, cancel))
+	if err != errIdleTimeout {
+		t.Fatalf("got error %v, expected errIdleTimeout", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("read %q, expected the data before the stall", data)
+	}
+}
@@ -2,12 +2,14 @@ package scraper
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 )
 
 type postsResponse struct {
 	Response struct {
-		Posts []*post `json:"posts"`
+		Posts      []*post `json:"posts"`
+		TotalPosts int64   `json:"total_posts"`
 	} `json:"response"`
 }
 
@@ -15,8 +17,34 @@ type post struct {
 	ID json.Number `json:"id"`
 	id int64
 
-	Timestamp int64        `json:"timestamp"`
-	Trail     []trailEntry `json:"trail"`
+	// The unmodified JSON this post was decoded from
+	raw json.RawMessage
+
+	// Number of media items found in this post, including those filtered out by the blog's config,
+	// which keeps the {index} of files stable when the filters change
+	mediaIndex int
+
+	// Number of files queued for download for this post
+	mediaCount int
+
+	// Set if the post was filtered out by the blog's config
+	skipped bool
+
+	// Set by RetryFailed for a file requeued by Verify, which is downloaded to exactly this path
+	fixedPath string
+
+	// Paths of all files downloaded for this post
+	files      []string
+	localFiles map[string]string
+	filesLock  sync.Mutex
+	pending    sync.WaitGroup
+
+	BlogName     string       `json:"blog_name"`
+	Type         string       `json:"type"`
+	OriginalType string       `json:"original_type"`
+	Timestamp    int64        `json:"timestamp"`
+	Tags         []string     `json:"tags"`
+	Trail        []trailEntry `json:"trail"`
 
 	// NPF content: https://www.tumblr.com/docs/npf
 	Content    []content `json:"content"`
@@ -24,10 +52,17 @@ type post struct {
 	PostAuthor string    `json:"post_author"`
 
 	// Compatibility with the private API used by Tumblr's Dashboard
-	Body     string  `json:"body"`
-	Photos   []photo `json:"photos"`
-	VideoURL string  `json:"video_url"`
-	Answer   string  `json:"answer"`
+	Body         string  `json:"body"`
+	Photos       []photo `json:"photos"`
+	VideoURL     string  `json:"video_url"`
+	VideoType    string  `json:"video_type"`
+	PermalinkURL string  `json:"permalink_url"`
+	AudioURL     string  `json:"audio_url"`
+	AlbumArt     string  `json:"album_art"`
+	Answer       string  `json:"answer"`
+	Title        string  `json:"title"`
+	Question     string  `json:"question"`
+	AskingName   string  `json:"asking_name"`
 
 	// Only defined for reblogs
 	RebloggedFromName string `json:"reblogged_from_name"`
@@ -35,16 +70,60 @@ type post struct {
 	Reblog            reblog `json:"reblog"`
 }
 
+func (s *post) UnmarshalJSON(data []byte) error {
+	type plainPost post
+	err := json.Unmarshal(data, (*plainPost)(s))
+	if err != nil {
+		return err
+	}
+
+	s.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
 func (s *post) timestamp() time.Time {
 	return time.Unix(s.Timestamp, 0)
 }
 
+// Returns the name of the blog this post originally stems from
+func (s *post) sourceBlogName() string {
+	for _, name := range []string{s.RebloggedRootName, s.RebloggedFromName, s.PostAuthor} {
+		if len(name) != 0 {
+			return name
+		}
+	}
+	return s.BlogName
+}
+
+func (s *post) addFile(rawurl string, path string) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.files = append(s.files, path)
+
+	if s.localFiles == nil {
+		s.localFiles = make(map[string]string)
+	}
+	s.localFiles[rawurl] = path
+}
+
+// localFile returns the path rawurl has been downloaded to, if any.
+func (s *post) localFile(rawurl string) (string, bool) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	path, ok := s.localFiles[rawurl]
+	return path, ok
+}
+
 type photo struct {
 	OriginalSize photoVariant `json:"original_size"`
 }
 
 type photoVariant struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
 }
 
 type reblog struct {
@@ -69,23 +148,61 @@ type trailEntry struct {
 type content struct {
 	Type  string          `json:"type"`
 	Media json.RawMessage `json:"media"`
+
+	// Only defined for media embedded from other sites and links
+	URL string `json:"url"`
+
+	// Only defined for text and link blocks
+	Text    string `json:"text"`
+	Subtype string `json:"subtype"`
+	Title   string `json:"title"`
+
+	// Only defined for audio and video blocks
+	Poster json.RawMessage `json:"poster"`
 }
 
-type imageMedia []struct {
+type imageMedia []imageVariant
+
+type imageVariant struct {
 	URL                   string `json:"url"`
 	Width                 int    `json:"width"`
 	Height                int    `json:"height"`
 	HasOriginalDimensions bool   `json:"has_original_dimensions"`
 }
 
+// Returns the variant with the original or otherwise the largest dimensions.
+func (s imageMedia) best() imageVariant {
+	best := s[0]
+	bestArea := s[0].Width * s[0].Height
+
+	for _, m := range s {
+		if m.HasOriginalDimensions {
+			return m
+		}
+		if area := m.Width * m.Height; area > bestArea {
+			best = m
+			bestArea = area
+		}
+	}
+
+	return best
+}
+
 type videoMedia struct {
 	URL string `json:"url"`
 }
 
+type audioMedia struct {
+	URL string `json:"url"`
+}
+
 type layout struct {
 	Type        string `json:"type"`
 	Blocks      []int  `json:"blocks"`
 	Attribution struct {
-		URL string `json:"url"`
+		URL  string `json:"url"`
+		Blog struct {
+			Name string `json:"name"`
+		} `json:"blog"`
 	} `json:"attribution"`
 }
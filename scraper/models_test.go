@@ -0,0 +1,21 @@
+package scraper
+
+import (
+	"testing"
+)
+
+func TestImageMediaBest(t *testing.T) {
+	ms := imageMedia{
+		{URL: "75", Width: 75, Height: 75},
+		{URL: "1280", Width: 1280, Height: 1280},
+		{URL: "500", Width: 500, Height: 500},
+	}
+	if best := ms.best(); best.URL != "1280" {
+		t.Errorf("best variant is %s, expected the largest one", best.URL)
+	}
+
+	ms[2].HasOriginalDimensions = true
+	if best := ms.best(); best.URL != "500" {
+		t.Errorf("best variant is %s, expected the original one", best.URL)
+	}
+}
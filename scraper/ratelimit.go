@@ -0,0 +1,151 @@
+package scraper
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+const (
+	rateLimitMinBackoff = 5 * time.Second
+	rateLimitMaxBackoff = 15 * time.Minute
+)
+
+// The Tumblr API reports its quotas using headers like
+//
+//	X-Ratelimit-Perday-Limit: 5000
+//	X-Ratelimit-Perday-Remaining: 4999
+//	X-Ratelimit-Perday-Reset: 86399
+//
+// with the reset being specified in seconds.
+var rateLimitWindows = []string{"Perday", "Perhour"}
+
+// rateLimiter delays API requests while a quota of the Tumblr API is exhausted
+// or after the server responded with "429 Too Many Requests".
+type rateLimiter struct {
+	lock        sync.Mutex
+	database    *database.Database
+	rateLimits  map[string]*database.RateLimit
+	pausedUntil time.Time
+	backoff     time.Duration
+}
+
+func newRateLimiter(db *database.Database) *rateLimiter {
+	rateLimits, err := db.GetRateLimits()
+	if err != nil {
+		log.Printf("failed to get rate limits: %v", err)
+		rateLimits = make(map[string]*database.RateLimit)
+	}
+
+	s := &rateLimiter{
+		database:   db,
+		rateLimits: rateLimits,
+	}
+
+	for _, rl := range rateLimits {
+		s.pauseIfExhausted(rl)
+	}
+
+	return s
+}
+
+// wait blocks until requests may be sent again.
+func (s *rateLimiter) wait(ctx context.Context) error {
+	for {
+		s.lock.Lock()
+		d := time.Until(s.pausedUntil)
+		s.lock.Unlock()
+
+		if d <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// update processes the rate limit headers of res and returns true if the request should be retried.
+func (s *rateLimiter) update(res *http.Response) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	changed := false
+
+	for _, window := range rateLimitWindows {
+		prefix := "X-Ratelimit-" + window + "-"
+
+		limit, err1 := strconv.Atoi(res.Header.Get(prefix + "Limit"))
+		remaining, err2 := strconv.Atoi(res.Header.Get(prefix + "Remaining"))
+		reset, err3 := strconv.Atoi(res.Header.Get(prefix + "Reset"))
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+
+		rl := &database.RateLimit{
+			Limit:     limit,
+			Remaining: remaining,
+			ResetAt:   now.Add(time.Duration(reset) * time.Second),
+		}
+		s.rateLimits[window] = rl
+		s.pauseIfExhausted(rl)
+		changed = true
+	}
+
+	if changed {
+		err := s.database.SaveRateLimits(s.rateLimits)
+		if err != nil {
+			log.Printf("failed to save rate limits: %v", err)
+		}
+	}
+
+	if res.StatusCode != http.StatusTooManyRequests {
+		s.backoff = 0
+		return false
+	}
+
+	if s.backoff == 0 {
+		s.backoff = rateLimitMinBackoff
+	} else if s.backoff < rateLimitMaxBackoff {
+		s.backoff *= 2
+		if s.backoff > rateLimitMaxBackoff {
+			s.backoff = rateLimitMaxBackoff
+		}
+	}
+
+	delay := s.backoff
+	if retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+		delay = time.Duration(retryAfter) * time.Second
+	}
+	delay += time.Duration(rand.Int63n(int64(delay/2) + 1))
+
+	s.pauseUntil(now.Add(delay))
+	return true
+}
+
+func (s *rateLimiter) pauseIfExhausted(rl *database.RateLimit) {
+	if rl.Remaining <= 0 {
+		s.pauseUntil(rl.ResetAt)
+	}
+}
+
+func (s *rateLimiter) pauseUntil(t time.Time) {
+	if !t.After(s.pausedUntil) || !t.After(time.Now()) {
+		return
+	}
+
+	s.pausedUntil = t
+	log.Printf("rate limited - pausing until %s", t.Format("2006-01-02T15:04:05Z07:00"))
+}
@@ -0,0 +1,40 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+func TestRateLimitExcludesMedia(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	url := env.server.AddMedia("photo1.jpg", "image/jpeg", []byte("photo 1"))
+
+	err := env.db.SaveRateLimits(map[string]*database.RateLimit{
+		"Perday": {Limit: 5000, Remaining: 0, ResetAt: time.Now().Add(time.Hour)},
+	})
+	if err == nil {
+		err = env.db.AddFailedDownload(&database.FailedDownload{Blog: env.blog.Name, PostID: 1, URL: url})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exhausted API quota must not delay downloads from the CDN.
+	env.scraper = NewScraper(env.scraper.client, env.config, env.db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = env.scraper.RetryFailed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.hasPhoto(1) {
+		t.Error("photo hasn't been downloaded")
+	}
+}
@@ -0,0 +1,455 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+const (
+	// The site is rendered into this directory inside the blog's target directory.
+	siteDirectory = "site"
+
+	sitePageSize      = 60
+	siteExcerptLength = 200
+)
+
+var siteTemplates = template.Must(template.New("").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1200px; padding: 0 1em; }
+nav { padding: 1em 0; border-bottom: 1px solid #ddd; }
+nav form { display: inline; margin-left: 1em; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 1em; }
+.card { display: block; color: inherit; text-decoration: none; border: 1px solid #ddd; padding: .5em; overflow: hidden; }
+.card img { width: 100%; height: 180px; object-fit: cover; }
+.card p { height: 180px; margin: 0; overflow: hidden; }
+.card time { display: block; color: #888; font-size: .8em; }
+.media img, .media video { display: block; max-width: 100%; margin: 1em 0; }
+.tags a { margin-right: .5em; }
+.pager { padding: 1em 0; }
+</style>
+</head>
+<body>
+<nav><a href="{{.Root}}index.html">{{.Blog}}</a> · <a href="{{.Root}}tags.html">Tags</a>
+{{with .Search}}<form action="{{$.Root}}index.html">
+<input name="tag" placeholder="tag" value="{{.Tag}}">
+<input name="from" type="date" value="{{.From}}">
+<input name="to" type="date" value="{{.To}}">
+<button>Search</button>
+</form>{{end}}</nav>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "list"}}{{template "header" .}}
+<h1>{{.Title}}</h1>
+<div class="grid">
+{{range .Posts}}<a class="card" href="{{$.Root}}post/{{.ID}}.html">
+{{with .Thumbnail}}<img loading="lazy" src="{{$.Root}}{{.}}">{{else}}<p>{{.Excerpt}}</p>{{end}}
+<time>{{.Date}}</time>
+</a>
+{{end}}</div>
+<p class="pager">{{with .Prev}}<a href="{{.}}">« newer</a>{{end}} Page {{.Page}} of {{.Pages}} {{with .Next}}<a href="{{.}}">older »</a>{{end}}</p>
+{{template "footer" .}}{{end}}
+
+{{define "post"}}{{template "header" .}}
+{{with .Post}}<h1>{{.Title}}</h1>
+<p><time>{{.Date}}</time></p>
+{{with .Tags}}<p class="tags">{{range .}}<a href="{{$.Root}}{{.URL}}">#{{.Name}}</a>{{end}}</p>{{end}}
+<div class="media">
+{{range .Media}}{{if eq .Type "video"}}<video controls preload="metadata" src="{{$.Root}}{{.URL}}"></video>
+{{else if eq .Type "audio"}}<audio controls preload="metadata" src="{{$.Root}}{{.URL}}"></audio>
+{{else}}<a href="{{$.Root}}{{.URL}}"><img loading="lazy" src="{{$.Root}}{{.URL}}"></a>
+{{end}}{{end}}</div>
+{{.Content}}
+{{end}}{{template "footer" .}}{{end}}
+
+{{define "tagIndex"}}{{template "header" .}}
+<h1>{{.Title}}</h1>
+<ul>
+{{range .Tags}}<li><a href="{{$.Root}}{{.URL}}">#{{.Name}}</a> ({{.Count}})</li>
+{{end}}</ul>
+{{template "footer" .}}{{end}}
+`))
+
+type sitePost struct {
+	ID        int64
+	Title     string
+	Date      string
+	Tags      []*siteTag
+	Thumbnail string
+	Excerpt   string
+	Media     []siteMedia
+	Content   template.HTML
+
+	timestamp time.Time
+}
+
+type siteMedia struct {
+	Type string
+	URL  string
+}
+
+type siteTag struct {
+	Name  string
+	URL   string
+	Count int
+
+	file  string
+	posts []*sitePost
+}
+
+// siteSearch contains the current values of the search form, which is only shown by Serve.
+type siteSearch struct {
+	Tag  string
+	From string
+	To   string
+}
+
+// sitePage is the data passed to the templates.
+// All URLs are relative to the site directory and prefixed with Root when used.
+type sitePage struct {
+	Blog   string
+	Title  string
+	Root   string
+	Search *siteSearch
+
+	// "list"
+	Posts []*sitePost
+	Page  int
+	Pages int
+	Prev  string
+	Next  string
+
+	// "post"
+	Post *sitePost
+
+	// "tagIndex"
+	Tags []*siteTag
+}
+
+// site contains the posts and tags of a blog.
+type site struct {
+	name    string
+	posts   []*sitePost
+	byID    map[int64]*sitePost
+	tags    map[string]*siteTag
+	tagList []*siteTag
+}
+
+// Render generates a static HTML site for every blog from its post archive (see BlogConfig.ArchivePosts).
+// The site consists of a paginated index ordered by date, a page per post and per tag.
+func Render(ctx context.Context, cfg *config.Config, db *database.Database) error {
+	for _, blog := range cfg.Blogs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		records, err := readPostArchive(blog.Target)
+		if os.IsNotExist(err) {
+			log.Printf("%s: skipping - no post archive found", blog.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		s, err := newSite(blog, db, records)
+		if err != nil {
+			return err
+		}
+
+		err = s.write(filepath.Join(blog.Target, siteDirectory))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%s: rendered %d posts into %s", blog.Name, len(records), filepath.Join(blog.Target, siteDirectory))
+	}
+
+	return nil
+}
+
+func newSite(blog *config.BlogConfig, db *database.Database, records []*PostRecord) (*site, error) {
+	s := &site{
+		name:  config.TumblrDomainToName(blog.Name),
+		posts: make([]*sitePost, 0, len(records)),
+		byID:  make(map[int64]*sitePost, len(records)),
+		tags:  make(map[string]*siteTag),
+	}
+
+	for _, record := range records {
+		p, err := newSitePost(blog, db, record)
+		if err != nil {
+			return nil, err
+		}
+		s.posts = append(s.posts, p)
+		s.byID[p.ID] = p
+
+		for _, tag := range record.Tags {
+			key := strings.ToLower(tag)
+			if len(key) == 0 {
+				continue
+			}
+
+			// Dashes are escaped so that the file can't collide with other tags' subsequent pages.
+			file := strings.Replace(url.PathEscape(key), "-", "%2D", -1)
+
+			t := s.tags[file]
+			if t == nil {
+				t = &siteTag{
+					Name: tag,
+					URL:  "tag/" + url.PathEscape(file) + ".html",
+					file: file,
+				}
+				s.tags[file] = t
+				s.tagList = append(s.tagList, t)
+			}
+
+			// A post might be tagged with differently cased variants of the same tag.
+			if len(t.posts) == 0 || t.posts[len(t.posts)-1] != p {
+				t.posts = append(t.posts, p)
+				t.Count++
+				p.Tags = append(p.Tags, t)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *site) newPage(title string, root string) *sitePage {
+	return &sitePage{Blog: s.name, Title: title, Root: root}
+}
+
+// write renders all pages of the site into dir.
+func (s *site) write(dir string) error {
+	for _, sub := range []string{"post", "tag"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := writeSiteList(dir, "index", s.newPage(s.name, ""), s.posts)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range s.posts {
+		page := s.newPage(p.Title, "../")
+		page.Post = p
+
+		err = writeSitePage(filepath.Join(dir, "post", strconv.FormatInt(p.ID, 10)+".html"), "post", page)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range s.tagList {
+		err = writeSiteList(filepath.Join(dir, "tag"), t.file, s.newPage("#"+t.Name, "../"), t.posts)
+		if err != nil {
+			return err
+		}
+	}
+
+	page := s.newPage("Tags", "")
+	page.Tags = s.tagList
+	return writeSitePage(filepath.Join(dir, "tags.html"), "tagIndex", page)
+}
+
+// list fills the page with the nth page of the posts.
+// The pages are named {base}.html, {base}-2.html and so on and query is appended to the links between them.
+func (s *sitePage) list(base string, posts []*sitePost, n int, query string) {
+	link := func(n int) string {
+		l := url.PathEscape(sitePageFilename(base, n))
+		if len(query) != 0 {
+			l += "?" + query
+		}
+		return l
+	}
+
+	s.Pages = sitePageCount(len(posts))
+	s.Page = n
+
+	start := (n - 1) * sitePageSize
+	end := start + sitePageSize
+	if start > len(posts) {
+		start = len(posts)
+	}
+	if end > len(posts) {
+		end = len(posts)
+	}
+	s.Posts = posts[start:end]
+
+	s.Prev = ""
+	s.Next = ""
+	if n > 1 {
+		s.Prev = link(n - 1)
+	}
+	if n < s.Pages {
+		s.Next = link(n + 1)
+	}
+}
+
+func sitePageCount(posts int) int {
+	pages := (posts + sitePageSize - 1) / sitePageSize
+	if pages == 0 {
+		pages = 1
+	}
+	return pages
+}
+
+func sitePageFilename(base string, n int) string {
+	if n == 1 {
+		return base + ".html"
+	}
+	return fmt.Sprintf("%s-%d.html", base, n)
+}
+
+func writeSiteList(dir string, base string, page *sitePage, posts []*sitePost) error {
+	for n := 1; n <= sitePageCount(len(posts)); n++ {
+		page.list(base, posts, n, "")
+
+		err := writeSitePage(filepath.Join(dir, sitePageFilename(base, n)), "list", page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSitePage(path string, name string, page *sitePage) error {
+	buf := &bytes.Buffer{}
+	err := siteTemplates.ExecuteTemplate(buf, name, page)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+func newSitePost(blog *config.BlogConfig, db *database.Database, record *PostRecord) (*sitePost, error) {
+	p := &post{}
+	if len(record.Post) != 0 {
+		err := json.Unmarshal(record.Post, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.id = record.ID
+
+	sp := &sitePost{
+		ID:        record.ID,
+		Title:     p.Title,
+		Date:      record.Timestamp.Format("2006-01-02 15:04"),
+		timestamp: record.Timestamp,
+	}
+	if len(sp.Title) == 0 {
+		sp.Title = fmt.Sprintf("Post %d", record.ID)
+	}
+
+	// The post's JSON refers to the media files by their URL.
+	// Site URLs are relative to the site directory, which is inside the target directory.
+	urls := make(map[string]string, len(record.Files))
+	for _, file := range record.Files {
+		fr, err := db.GetFileRecord(filepath.Join(blog.Target, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, err
+		}
+		if fr != nil {
+			urls[fr.URL] = file
+		}
+	}
+
+	used := make(map[string]bool)
+	r := &postRenderer{
+		resolve: func(rawurl string) string {
+			file, ok := urls[rawurl]
+			if !ok {
+				file, ok = urls[fixupURL(rawurl)]
+			}
+			if !ok {
+				return rawurl
+			}
+
+			// The post pages are located in a subdirectory of the site.
+			used[file] = true
+			return "../../" + siteFileURL(file)
+		},
+	}
+
+	err := r.content(p)
+	if err != nil {
+		return nil, err
+	}
+	// The post's HTML fragments are sanitized by the postRenderer, which makes them safe to embed as is.
+	sp.Content = template.HTML(r.buf.String())
+	sp.Excerpt = htmlExcerpt(r.buf.String())
+
+	for _, file := range record.Files {
+		t := mediaTypeOf(file)
+		if len(sp.Thumbnail) == 0 && (t == mediaTypeImage || t == mediaTypeGIF) {
+			sp.Thumbnail = "../" + siteFileURL(file)
+		}
+		if !used[file] {
+			sp.Media = append(sp.Media, siteMedia{Type: t, URL: "../" + siteFileURL(file)})
+		}
+	}
+
+	return sp, nil
+}
+
+func siteFileURL(file string) string {
+	return (&url.URL{Path: file}).String()
+}
+
+// htmlExcerpt returns the beginning of the text content of the HTML fragment.
+func htmlExcerpt(fragment string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(fragment))
+
+	for b.Len() < siteExcerptLength {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			text := strings.Join(strings.Fields(string(z.Text())), " ")
+			if len(text) != 0 {
+				if b.Len() != 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(text)
+			}
+		}
+	}
+
+	excerpt := b.String()
+	for len(excerpt) > siteExcerptLength || !utf8.ValidString(excerpt) {
+		excerpt = excerpt[:len(excerpt)-1]
+	}
+	return excerpt + "…"
+}
@@ -0,0 +1,30 @@
+package scraper
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+func TestNewSitePostSanitizesContent(t *testing.T) {
+	record := &PostRecord{
+		ID:        1,
+		Timestamp: time.Unix(1500000000, 0),
+		Post:      []byte(`{"type":"text","blog_name":"example","body":"<p>text</p><script>alert(1)</script><img src=\"x.png\" onerror=\"alert(2)\">"}`),
+	}
+
+	sp, err := newSitePost(&config.BlogConfig{Name: testBlogName}, nil, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := string(sp.Content)
+	if strings.Contains(content, "alert") {
+		t.Errorf("content contains scripts: %s", content)
+	}
+	if !strings.Contains(content, "<p>text</p>") || !strings.Contains(content, `<img src="x.png"/>`) {
+		t.Errorf("content is missing the post's body: %s", content)
+	}
+}
@@ -0,0 +1,117 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+var defaultRetryConfig = config.RetryConfig{
+	MaxAttempts:    3,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     time.Minute,
+	RetryStatuses:  []int{408, 502, 503, 504},
+}
+
+// statusError is returned for responses with an unexpected status code.
+type statusError struct {
+	url        string
+	statusCode int
+	status     string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s failed with: %d %s", e.url, e.statusCode, e.status)
+}
+
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	retryStatuses  map[int]struct{}
+}
+
+func newRetryPolicy(cfg *config.RetryConfig) *retryPolicy {
+	c := defaultRetryConfig
+	if cfg != nil {
+		if cfg.MaxAttempts > 0 {
+			c.MaxAttempts = cfg.MaxAttempts
+		}
+		if cfg.InitialBackoff > 0 {
+			c.InitialBackoff = cfg.InitialBackoff
+		}
+		if cfg.MaxBackoff > 0 {
+			c.MaxBackoff = cfg.MaxBackoff
+		}
+		if cfg.RetryStatuses != nil {
+			c.RetryStatuses = cfg.RetryStatuses
+		}
+	}
+
+	s := &retryPolicy{
+		maxAttempts:    c.MaxAttempts,
+		initialBackoff: c.InitialBackoff,
+		maxBackoff:     c.MaxBackoff,
+		retryStatuses:  make(map[int]struct{}, len(c.RetryStatuses)),
+	}
+	for _, status := range c.RetryStatuses {
+		s.retryStatuses[status] = struct{}{}
+	}
+
+	return s
+}
+
+// do calls f until it succeeds, fails with a non-retryable error or the maximum number of attempts is reached.
+// It returns the number of attempts made.
+func (s *retryPolicy) do(ctx context.Context, f func() error) (int, error) {
+	backoff := s.initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= s.maxAttempts || !s.isRetryable(ctx, err) {
+			return attempt, err
+		}
+
+		// Jitter the delay within [backoff/2, backoff]
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, ctx.Err()
+		case <-t.C:
+		}
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s *retryPolicy) isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		_, ok := s.retryStatuses[se.statusCode]
+		return ok
+	}
+
+	// Truncated or stalled bodies and resumed downloads which need to be restarted
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errInvalidRange) || errors.Is(err, errIdleTimeout) {
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
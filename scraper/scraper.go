@@ -2,6 +2,8 @@ package scraper
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +19,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/html"
@@ -26,11 +29,21 @@ import (
 	"github.com/lhecker/tumblr-scraper/account"
 	"github.com/lhecker/tumblr-scraper/config"
 	"github.com/lhecker/tumblr-scraper/database"
+	"github.com/lhecker/tumblr-scraper/events"
+	"github.com/lhecker/tumblr-scraper/metrics"
 	"github.com/lhecker/tumblr-scraper/semaphore"
+	"github.com/lhecker/tumblr-scraper/throttle"
+)
+
+const (
+	// Files are downloaded into a temporary file with this extension first
+	// and only renamed to their final path once they're complete.
+	partExtension = ".part"
 )
 
 var (
 	errFileNotFound = errors.New("file not found")
+	errInvalidRange = errors.New("invalid range response")
 
 	deactivatedNameSuffixLength = 20
 	deactivatedNameRegexp       = regexp.MustCompile(`.-deactivated\d{8}$`)
@@ -38,12 +51,24 @@ var (
 	videoURLFixupRegexp  = regexp.MustCompile(`_(?:480|720)\.mp4$`)
 	imageSizeFixupRegexp = regexp.MustCompile(`_(?:\d+)\.([a-z]+)$`)
 
-	mediaURLRegexp     = regexp.MustCompile(`^http.+(?:media|vtt)\.tumblr\.com/.+$`)
-	htmlMediaURLRegexp = regexp.MustCompile(`http[^"]+(?:media|vtt)\.tumblr\.com/[^"]+`)
+	mediaURLRegexp     = regexp.MustCompile(`^http.+(?:media|vtt|/a)\.tumblr\.com/.+$`)
+	htmlMediaURLRegexp = regexp.MustCompile(`http[^"]+(?:media|vtt|/a)\.tumblr\.com/[^"]+`)
 )
 
+// The extension used for files without a matching one, by their Content-Type.
+// mime.ExtensionsByType is unsuitable for that, since it returns all known extensions in alphabetical order.
+var preferredExtensions = make(map[string]string)
+
 func init() {
 	for _, e := range []struct{ typ, ext string }{
+		{"audio/aac", ".aac"},
+		{"audio/flac", ".flac"},
+		{"audio/mp4", ".m4a"},
+		{"audio/mpeg", ".mp3"},
+		{"audio/ogg", ".ogg"},
+		{"audio/wav", ".wav"},
+		{"audio/x-m4a", ".m4a"},
+		{"audio/x-wav", ".wav"},
 		{"image/bmp", ".bmp"},
 		{"image/gif", ".gif"},
 		{"image/jpeg", ".jpg"},
@@ -56,6 +81,7 @@ func init() {
 		if err != nil {
 			panic(err)
 		}
+		preferredExtensions[e.typ] = e.ext
 	}
 }
 
@@ -63,35 +89,141 @@ type Scraper struct {
 	client   *http.Client
 	config   *config.Config
 	database *database.Database
+	dedupe   *dedupeStore
+	limiter  *rateLimiter
+	retry    *retryPolicy
+	events   events.Sink
+
+	// Like client, but without its overall timeout, see mediaIdleTimeout.
+	mediaClient *http.Client
+
+	// Shared by all blogs scraped in parallel.
+	sema      *semaphore.FairSemaphore
+	bandwidth *throttle.Limiter
 }
 
 func NewScraper(client *http.Client, config *config.Config, database *database.Database) *Scraper {
-	return &Scraper{
+	s := &Scraper{
 		client:   client,
 		config:   config,
 		database: database,
+		limiter:  newRateLimiter(database),
+		retry:    newRetryPolicy(config.Retry),
+		sema:     semaphore.NewFairSemaphore(config.Concurrency),
+	}
+	mediaClient := *client
+	mediaClient.Timeout = 0
+	s.mediaClient = &mediaClient
+	s.bandwidth = throttle.NewLimiter(config.Network)
+
+	if len(config.Dedupe) != 0 {
+		s.dedupe = newDedupeStore(config, database)
 	}
+
+	return s
 }
 
-func (s *Scraper) Scrape(ctx context.Context, blogConfig *config.BlogConfig) (int64, error) {
-	err := os.MkdirAll(blogConfig.Target, 0755)
+func (s *Scraper) Scrape(ctx context.Context, blogConfig *config.BlogConfig) (highestID int64, err error) {
+	err = os.MkdirAll(blogConfig.Target, 0755)
 	if err != nil {
 		return 0, err
 	}
 
+	stats := &events.Stats{}
+	defer func() {
+		if err == nil {
+			s.emit(&events.Event{
+				Type:      events.BlogFinished,
+				Blog:      blogConfig.Name,
+				HighestID: highestID,
+				Bytes:     stats.Bytes,
+				Stats:     stats,
+			})
+		}
+	}()
+
+	// Without a date window we simply scrape everything newer than the highest ID.
+	if blogConfig.After == nil && blogConfig.Before == nil {
+		sc, err := s.scrapeRange(ctx, blogConfig, database.DateRange{}, true)
+		if err != nil {
+			return 0, err
+		}
+		*stats = sc.loadStats()
+		return sc.highestID, nil
+	}
+
+	// The highest ID only ever refers to an uninterrupted scrape starting at the newest post.
+	// Date windows leave it untouched and are tracked in the coverage table instead.
+	highestID, err = s.database.GetHighestID(blogConfig.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	ranges, err := s.uncoveredRanges(blogConfig, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if len(ranges) == 0 {
+		log.Printf("%s: date window has already been scraped", blogConfig.Name)
+	}
+
+	for _, r := range ranges {
+		sc, err := s.scrapeRange(ctx, blogConfig, r, false)
+		if err != nil {
+			return 0, err
+		}
+		st := sc.loadStats()
+		stats.Add(&st)
+	}
+
+	return highestID, nil
+}
+
+// scrapeRange scrapes all posts in r, or all posts newer than the highest ID if r is zero and useHighestID is true.
+// The scraped date range is recorded in the database.
+func (s *Scraper) scrapeRange(ctx context.Context, blogConfig *config.BlogConfig, r database.DateRange, useHighestID bool) (*scrapeContext, error) {
 	eg, ctx := errgroup.WithContext(ctx)
 
 	sc, err := newScrapeContext(s, blogConfig, eg, ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	sc.before = r.To
+	sc.until = r.To
+	sc.after = r.From
+	sc.top = r.To
+	if sc.top.IsZero() {
+		sc.top = time.Now()
+	}
+	if !useHighestID {
+		sc.initialHighestID = math.MinInt64
+	}
+
+	err = sc.restoreCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if blogConfig.ArchivePosts {
+		sc.archive, err = openPostArchive(blogConfig.Target)
+		if err != nil {
+			return nil, err
+		}
+		defer sc.archive.Close()
 	}
 
 	err = sc.Scrape()
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	err = s.database.AddCoverage(blogConfig.Name, database.DateRange{From: sc.bottom, To: sc.top})
+	if err != nil {
+		return nil, err
 	}
 
-	return sc.highestID, nil
+	return sc, nil
 }
 
 type scrapeContextState int
@@ -117,13 +249,33 @@ type scrapeContext struct {
 	offset int
 	before time.Time
 
+	// Posts outside of [after, until) are ignored. Zero values are unbounded.
+	after time.Time
+	until time.Time
+
 	// Informational values
-	lowestID  int64
-	highestID int64
+	lowestID         int64
+	highestID        int64
+	initialHighestID int64
+
+	// The date range covered by this scrape once it finishes
+	top    time.Time
+	bottom time.Time
+
+	// Checkpointing of the pagination state
+	page             *scrapePage
+	lastCheckpoint   chan struct{}
+	checkpointFailed int32
+
+	// Counters for the event stream, updated atomically
+	stats events.Stats
 
 	// Other private members
-	sema         *semaphore.PrioritySemaphore
+	archive      *postArchive
+	sema         *semaphore.FairSemaphoreGroup
 	allowedBlogs map[string]struct{}
+	includeTags  map[string]struct{}
+	excludeTags  map[string]struct{}
 }
 
 func newScrapeContext(
@@ -145,7 +297,7 @@ func newScrapeContext(
 		lowestID:  math.MaxInt64,
 		highestID: math.MinInt64,
 
-		sema: semaphore.NewPrioritySemaphore(s.config.Concurrency),
+		sema: s.sema.Group(blogConfig.Name),
 	}
 
 	if !blogConfig.Rescrape {
@@ -154,10 +306,7 @@ func newScrapeContext(
 			return nil, err
 		}
 	}
-
-	if !blogConfig.Before.IsZero() {
-		sc.before = blogConfig.Before
-	}
+	sc.initialHighestID = sc.highestID
 
 	if blogConfig.AllowReblogsFrom != nil {
 		sc.allowedBlogs = map[string]struct{}{
@@ -169,11 +318,30 @@ func newScrapeContext(
 		}
 	}
 
+	sc.includeTags = newTagSet(blogConfig.IncludeTags)
+	sc.excludeTags = newTagSet(blogConfig.ExcludeTags)
+
 	return sc, nil
 }
 
+func newTagSet(tags []string) map[string]struct{} {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		set[strings.ToLower(tag)] = struct{}{}
+	}
+	return set
+}
+
 func (sc *scrapeContext) Scrape() (err error) {
-	log.Printf("%s: scraping starting at %d", sc.blogConfig.Name, sc.highestID)
+	if sc.offset == 0 {
+		log.Printf("%s: scraping starting at %d", sc.blogConfig.Name, sc.highestID)
+	} else {
+		log.Printf("%s: scraping resuming at offset %d", sc.blogConfig.Name, sc.offset)
+	}
 	defer func() { log.Printf("%s: scraping finished at %d", sc.blogConfig.Name, sc.highestID) }()
 
 	defer func() {
@@ -181,9 +349,13 @@ func (sc *scrapeContext) Scrape() (err error) {
 		if err == nil {
 			err = e
 		}
-	}()
 
-	initialHighestID := sc.highestID
+		// Checkpoints depend on the downloads in the errgroup and must be written
+		// before the caller finishes the scrape by calling SetHighestID.
+		if sc.lastCheckpoint != nil {
+			<-sc.lastCheckpoint
+		}
+	}()
 
 	for {
 		if sc.before.IsZero() {
@@ -208,30 +380,53 @@ func (sc *scrapeContext) Scrape() (err error) {
 			}
 		}
 
-		for _, post := range res.Response.Posts {
-			if post.id < sc.lowestID {
-				sc.lowestID = post.id
-			}
-			if post.id > sc.highestID {
-				sc.highestID = post.id
-			}
+		sc.page = &scrapePage{}
+		sc.pageFetched(res)
 
+		for _, post := range res.Response.Posts {
 			timestamp := post.timestamp()
 			if sc.before.IsZero() || timestamp.Before(sc.before) {
 				sc.before = timestamp
 			}
 
-			if post.id <= initialHighestID {
+			if post.id <= sc.initialHighestID {
+				sc.bottom = timestamp
 				return
 			}
+			if !sc.after.IsZero() && timestamp.Before(sc.after) {
+				sc.bottom = sc.after
+				return
+			}
+			// The indash API doesn't support the "before" parameter.
+			if !sc.until.IsZero() && !timestamp.Before(sc.until) {
+				continue
+			}
+
+			// Only posts within the window count, since skipped newer ones would otherwise
+			// be mistaken as scraped once the highest ID is saved.
+			if post.id < sc.lowestID {
+				sc.lowestID = post.id
+			}
+			if post.id > sc.highestID {
+				sc.highestID = post.id
+			}
 
 			err = sc.scrapePost(post)
 			if err != nil {
 				return
 			}
+			sc.postScraped(post)
+
+			if sc.archive != nil && !post.skipped {
+				sc.archivePostAsync(post)
+			}
+			if len(sc.blogConfig.ExportPosts) != 0 && !post.skipped {
+				sc.exportPostAsync(post)
+			}
 		}
 
 		sc.offset += len(res.Response.Posts)
+		sc.checkpointAsync()
 	}
 }
 
@@ -321,9 +516,30 @@ func (sc *scrapeContext) isBlogAllowed(name string) bool {
 	return ok
 }
 
+// Returns true if the post has any of the included and none of the excluded tags.
+func (sc *scrapeContext) handleTags(post *post) bool {
+	included := sc.includeTags == nil
+
+	for _, tag := range post.Tags {
+		tag = strings.ToLower(tag)
+		if _, ok := sc.excludeTags[tag]; ok {
+			return false
+		}
+		if _, ok := sc.includeTags[tag]; ok {
+			included = true
+		}
+	}
+
+	return included
+}
+
 func (sc *scrapeContext) scrapeBlog() (data *postsResponse, err error) {
 	for data == nil {
-		data, err = sc.scrapeBlogMaybe()
+		_, err = sc.scraper.retry.do(sc.ctx, func() error {
+			var e error
+			data, e = sc.scrapeBlogMaybe()
+			return e
+		})
 		if err != nil {
 			return
 		}
@@ -344,13 +560,13 @@ func (sc *scrapeContext) scrapeBlogMaybe() (*postsResponse, error) {
 	switch sc.state {
 	case scrapeContextStateTryUseIndashAPI, scrapeContextStateUseIndashAPI:
 		url = sc.getIndashBlogPostsURL()
-		res, err = sc.doGetRequest(url, http.Header{
-			"Referer":          {"https://www.tumblr.com/dashboard"},
+		res, err = sc.doGetRequest("indash", url, http.Header{
+			"Referer":          {sc.scraper.config.WebBaseURLOrDefault() + "/dashboard"},
 			"X-Requested-With": {"XMLHttpRequest"},
 		})
 	default:
 		url = sc.getAPIPostsURL()
-		res, err = sc.doGetRequest(url, nil)
+		res, err = sc.doGetRequest("api", url, nil)
 	}
 
 	if err != nil {
@@ -371,7 +587,7 @@ func (sc *scrapeContext) scrapeBlogMaybe() (*postsResponse, error) {
 			sc.state = scrapeContextStateUseIndashAPI
 			return nil, nil
 		}
-		return nil, fmt.Errorf("GET %s failed with: %d %s", url, res.StatusCode, res.Status)
+		return nil, &statusError{url.String(), res.StatusCode, res.Status}
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
@@ -398,7 +614,8 @@ func (sc *scrapeContext) scrapePost(post *post) error {
 	// Scraping logic for NPF posts
 	//
 
-	if !sc.handleReblogs(post) {
+	if !sc.handleTags(post) || !sc.handlePostType(post) || !sc.handleReblogs(post) {
+		post.skipped = true
 		return nil
 	}
 
@@ -445,10 +662,19 @@ func (sc *scrapeContext) scrapePost(post *post) error {
 	}
 
 	for _, photo := range post.Photos {
-		sc.downloadFileAsync(post, photo.OriginalSize.URL)
+		sc.downloadMediaAsync(post, photo.OriginalSize.URL, photo.OriginalSize.Width, photo.OriginalSize.Height)
 	}
 	if len(post.VideoURL) != 0 {
-		sc.downloadFileAsync(post, post.VideoURL)
+		sc.downloadMediaAsync(post, post.VideoURL, 0, 0)
+	} else if len(post.VideoType) != 0 && post.VideoType != "tumblr" && len(post.PermalinkURL) != 0 {
+		sc.externalDownloadAsync(post, post.PermalinkURL)
+	}
+	// Audio posts may embed files from other providers like Spotify or SoundCloud.
+	if len(post.AudioURL) != 0 && strings.Contains(post.AudioURL, "tumblr.com") {
+		sc.downloadMediaAsync(post, post.AudioURL, 0, 0)
+	}
+	if len(post.AlbumArt) != 0 {
+		sc.downloadMediaAsync(post, post.AlbumArt, 0, 0)
 	}
 
 	return nil
@@ -465,6 +691,11 @@ func (sc *scrapeContext) scrapeNpfContent(post *post, cs []content, ls []layout)
 	}
 
 	for _, c := range cs {
+		// Videos embedded from other sites like YouTube only have a URL.
+		if c.Type == "video" && len(c.Media) == 0 && len(c.URL) != 0 {
+			sc.externalDownloadAsync(post, c.URL)
+			continue
+		}
 		if len(c.Media) == 0 {
 			continue
 		}
@@ -477,20 +708,8 @@ func (sc *scrapeContext) scrapeNpfContent(post *post, cs []content, ls []layout)
 				return err
 			}
 
-			bestURL := ms[0].URL
-			bestArea := ms[0].Width * ms[0].Height
-
-			for _, m := range ms {
-				if m.HasOriginalDimensions {
-					bestURL = m.URL
-					break
-				}
-				if m.Width*m.Height > bestArea {
-					bestURL = m.URL
-				}
-			}
-
-			sc.downloadFileAsync(post, bestURL)
+			best := ms.best()
+			sc.downloadMediaAsync(post, best.URL, best.Width, best.Height)
 		case "video":
 			var ms videoMedia
 			err := json.Unmarshal(c.Media, &ms)
@@ -499,7 +718,31 @@ func (sc *scrapeContext) scrapeNpfContent(post *post, cs []content, ls []layout)
 			}
 
 			if strings.Contains(ms.URL, "tumblr.com") {
-				sc.downloadFileAsync(post, ms.URL)
+				sc.downloadMediaAsync(post, ms.URL, 0, 0)
+			} else if len(ms.URL) != 0 {
+				sc.externalDownloadAsync(post, ms.URL)
+			}
+		case "audio":
+			var ms audioMedia
+			err := json.Unmarshal(c.Media, &ms)
+			if err != nil {
+				return err
+			}
+
+			if strings.Contains(ms.URL, "tumblr.com") {
+				sc.downloadMediaAsync(post, ms.URL, 0, 0)
+			}
+
+			// The album art
+			if len(c.Poster) != 0 {
+				var ps imageMedia
+				err := json.Unmarshal(c.Poster, &ps)
+				if err != nil {
+					return err
+				}
+				if len(ps) != 0 {
+					sc.downloadMediaAsync(post, ps[0].URL, ps[0].Width, ps[0].Height)
+				}
 			}
 		}
 	}
@@ -539,7 +782,7 @@ func (sc *scrapeContext) scrapePostBody(post *post, text string) {
 			switch attr.Key {
 			case "href", "src", "data-big-photo":
 				if mediaURLRegexp.MatchString(attr.Val) {
-					sc.downloadFileAsync(post, attr.Val)
+					sc.downloadMediaAsync(post, attr.Val, 0, 0)
 				}
 			}
 		}
@@ -548,31 +791,61 @@ func (sc *scrapeContext) scrapePostBody(post *post, text string) {
 
 func (sc *scrapeContext) scrapePostBodyUsingSearch(post *post, text string) {
 	for _, u := range htmlMediaURLRegexp.FindAllString(text, -1) {
-		sc.downloadFileAsync(post, u)
+		sc.downloadMediaAsync(post, u, 0, 0)
 	}
 }
 
-func (sc *scrapeContext) downloadFileAsync(post *post, rawurl string) {
+func (sc *scrapeContext) downloadFileAsync(post *post, index int, rawurl string) {
 	if len(rawurl) == 0 {
 		panic("missing url")
 	}
 
+	page := sc.page
+	page.wg.Add(1)
+	post.pending.Add(1)
+
+	post.mediaCount++
+
 	sc.sema.Acquire(sc.offset)
 	sc.errgroup.Go(func() error {
 		defer sc.sema.Release()
-		return sc.downloadFile(post, rawurl)
+
+		err := sc.downloadFile(post, index, rawurl)
+		if err != nil {
+			atomic.StoreInt32(&page.failed, 1)
+		}
+		post.pending.Done()
+		page.wg.Done()
+		return err
 	})
 }
 
-func (sc *scrapeContext) downloadFile(post *post, rawurl string) error {
-	optimalRawurl := sc.fixupURL(rawurl)
+func (sc *scrapeContext) downloadFile(post *post, index int, rawurl string) error {
+	attempts, err := sc.downloadFileWithRetries(post, index, rawurl)
+	if err != nil {
+		log.Printf("%s: failed to download file: %v", sc.blogConfig.Name, err)
 
-	// First try to download the optimal URL (i.e. the highest resolution)
-	// and fall back to the original URL if that fails with a 404 error.
-	err := sc.downloadFileMaybe(post, optimalRawurl)
-	if err == errFileNotFound && optimalRawurl != rawurl {
-		err = sc.downloadFileMaybe(post, rawurl)
+		// Failed downloads are recorded for later instead of aborting the entire scrape.
+		if sc.ctx.Err() == nil {
+			sc.fileFailed(post, rawurl, attempts, err)
+			err = sc.scraper.database.AddFailedDownload(newFailedDownload(sc.blogConfig.Name, post, index, rawurl, attempts, err))
+		}
 	}
+	return err
+}
+
+func (sc *scrapeContext) downloadFileWithRetries(post *post, index int, rawurl string) (int, error) {
+	optimalRawurl := fixupURL(rawurl)
+
+	attempts, err := sc.scraper.retry.do(sc.ctx, func() error {
+		// First try to download the optimal URL (i.e. the highest resolution)
+		// and fall back to the original URL if that fails with a 404 error.
+		err := sc.downloadFileMaybe(post, index, optimalRawurl)
+		if err == errFileNotFound && optimalRawurl != rawurl {
+			err = sc.downloadFileMaybe(post, index, rawurl)
+		}
+		return err
+	})
 
 	// Ignore 404 errors
 	if err == errFileNotFound {
@@ -580,29 +853,58 @@ func (sc *scrapeContext) downloadFile(post *post, rawurl string) error {
 		err = nil
 	}
 
-	if err != nil {
-		log.Printf("%s: failed to download file: %v", sc.blogConfig.Name, err)
-	}
-	return err
+	return attempts, err
 }
 
-func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
+func (sc *scrapeContext) downloadFileMaybe(post *post, index int, rawurl string) error {
 	u, err := url.Parse(rawurl)
 	if err != nil {
 		return err
 	}
 
-	path := filepath.Join(sc.blogConfig.Target, filepath.Base(rawurl))
+	vars := newFilenameVars(post, index, rawurl)
+	path := sc.filepath(vars)
 	fileTime := post.timestamp()
 
 	// File already exists --> nothing to do here.
 	_, err = os.Lstat(path)
 	if err == nil {
 		log.Printf("%s: skipping %s", sc.blogConfig.Name, path)
+		post.addFile(rawurl, path)
+		sc.fileSkipped(post, rawurl, path)
 		return nil
 	}
 
-	res, err := sc.doGetRequest(u, nil)
+	// The same URL was already downloaded for another blog --> link it instead.
+	if sc.scraper.dedupe != nil {
+		if stored, hash, ok := sc.scraper.dedupe.lookup(rawurl); ok {
+			return sc.linkFile(post, rawurl, vars, stored, hash)
+		}
+	}
+
+	// The temporary file is based on the path before fixupFilepath()
+	// so that we can find it again before sending the request.
+	partPath := path + partExtension
+	if !acquireFile(partPath) {
+		return nil
+	}
+	defer releaseFile(partPath)
+
+	// Resume previously interrupted downloads using a Range request.
+	var header http.Header
+	partSize := int64(0)
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+		partSize = info.Size()
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", partSize)}}
+	}
+
+	// Downloads of large files may take arbitrarily long, especially if they're throttled.
+	// Instead of using a timeout for the entire request they're aborted once no data is received for a while.
+	ctx, cancel := context.WithCancel(sc.ctx)
+	defer cancel()
+
+	started := time.Now()
+	res, err := sc.doRequest(ctx, sc.scraper.mediaClient, "media", u, header)
 	if err != nil {
 		return err
 	}
@@ -610,7 +912,18 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 
 	switch res.StatusCode {
 	case http.StatusOK:
-		// continue below
+		// The server ignored the Range header --> start from scratch
+		partSize = 0
+	case http.StatusPartialContent:
+		var start int64
+		_, err = fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+		if err != nil || start != partSize {
+			_ = os.Remove(partPath)
+			return errInvalidRange
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		_ = os.Remove(partPath)
+		return errInvalidRange
 	case http.StatusForbidden:
 		// If a video or image was fully/entirely deleted (e.g. due to DMCA) it will
 		// still be linked inside the posts but result in a "403 Forbidden" error.
@@ -620,7 +933,7 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 	case http.StatusInternalServerError:
 		return errFileNotFound
 	default:
-		return fmt.Errorf("GET %s failed with: %d %s", rawurl, res.StatusCode, res.Status)
+		return &statusError{rawurl, res.StatusCode, res.Status}
 	}
 
 	lastModifiedString := res.Header.Get("Last-Modified")
@@ -633,7 +946,7 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 		}
 	}
 
-	fixedPath := sc.fixupFilepath(res, path)
+	fixedPath := sc.fixupFilepath(res, vars)
 	if fixedPath != path {
 		path = fixedPath
 
@@ -641,6 +954,8 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 		_, err = os.Lstat(path)
 		if err == nil {
 			log.Printf("%s: skipping %s", sc.blogConfig.Name, path)
+			post.addFile(rawurl, path)
+			sc.fileSkipped(post, rawurl, path)
 			return nil
 		}
 	}
@@ -650,21 +965,44 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 	}
 	defer releaseFile(path)
 
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	if partSize != 0 {
+		err = hashFileInto(hasher, partPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if partSize != 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(partPath, flags, 0644)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(file, res.Body)
+	// On failure the temporary file is kept, so that the download can be resumed later on.
+	body := newIdleTimeoutReader(res.Body, mediaIdleTimeout, cancel)
+	written, err := io.Copy(io.MultiWriter(file, hasher), sc.scraper.bandwidth.Reader(sc.ctx, body))
 	if err != nil {
 		_ = file.Close()
-		_ = os.Remove(path)
 		return err
 	}
 
 	err = file.Close()
 	if err != nil {
-		_ = os.Remove(path)
+		return err
+	}
+
+	err = os.Rename(partPath, path)
+	if err != nil {
 		return err
 	}
 
@@ -673,12 +1011,86 @@ func (sc *scrapeContext) downloadFileMaybe(post *post, rawurl string) error {
 		return err
 	}
 
+	metrics.DownloadDuration.Observe(time.Since(started).Seconds())
+	metrics.DownloadedBytes.Add(float64(written), sc.blogConfig.Name)
+
 	log.Printf("%s: wrote %s", sc.blogConfig.Name, path)
+	post.addFile(rawurl, path)
+	sc.fileWritten(post, rawurl, path, partSize+written, false)
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	sc.recordFile(post, index, rawurl, path, partSize+written, hash)
+
+	if sc.scraper.dedupe != nil {
+		linked, err := sc.scraper.dedupe.add(rawurl, hash, path)
+		if err != nil {
+			log.Printf("%s: failed to dedupe %s: %v", sc.blogConfig.Name, path, err)
+		} else if linked {
+			log.Printf("%s: linked %s", sc.blogConfig.Name, path)
+		}
+	}
+
+	return nil
+}
+
+// recordFile records the file downloaded or linked to path.
+// The record allows verifying the integrity of the file later on.
+func (sc *scrapeContext) recordFile(post *post, index int, rawurl string, path string, size int64, hash string) {
+	err := sc.scraper.database.SetFileRecord(path, &database.FileRecord{
+		Blog:   sc.blogConfig.Name,
+		URL:    rawurl,
+		Size:   size,
+		SHA256: hash,
+		PostID: post.id,
+		Index:  index,
+	})
+	if err != nil {
+		log.Printf("%s: failed to record %s: %v", sc.blogConfig.Name, path, err)
+	}
+}
+
+func (sc *scrapeContext) linkFile(post *post, rawurl string, vars *filenameVars, stored string, hash string) error {
+	vars.ext = filepath.Ext(stored)
+	path := sc.filepath(vars)
+
+	_, err := os.Lstat(path)
+	if err == nil {
+		log.Printf("%s: skipping %s", sc.blogConfig.Name, path)
+		post.addFile(rawurl, path)
+		sc.fileSkipped(post, rawurl, path)
+		return nil
+	}
+
+	if !acquireFile(path) {
+		return nil
+	}
+	defer releaseFile(path)
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = sc.scraper.dedupe.link(stored, path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%s: linked %s", sc.blogConfig.Name, path)
+	sc.recordFile(post, vars.index, rawurl, path, info.Size(), hash)
+	post.addFile(rawurl, path)
+	sc.fileWritten(post, rawurl, path, 0, true)
 	return nil
 }
 
 func (sc *scrapeContext) getAPIPostsURL() *url.URL {
-	u, err := url.Parse(fmt.Sprintf("https://api.tumblr.com/v2/blog/%s/posts", sc.blogConfig.Name))
+	u, err := url.Parse(fmt.Sprintf("%s/v2/blog/%s/posts", sc.scraper.config.APIBaseURLOrDefault(), sc.blogConfig.Name))
 	if err != nil {
 		panic(err)
 	}
@@ -694,13 +1106,17 @@ func (sc *scrapeContext) getAPIPostsURL() *url.URL {
 	if !sc.before.IsZero() {
 		vals.Set("before", strconv.FormatInt(sc.before.Unix(), 10))
 	}
+	// The API only supports filtering by a single tag.
+	if len(sc.blogConfig.IncludeTags) == 1 {
+		vals.Set("tag", sc.blogConfig.IncludeTags[0])
+	}
 	u.RawQuery = vals.Encode()
 
 	return u
 }
 
 func (sc *scrapeContext) getIndashBlogPostsURL() *url.URL {
-	u, err := url.Parse("https://www.tumblr.com/svc/indash_blog")
+	u, err := url.Parse(sc.scraper.config.WebBaseURLOrDefault() + "/svc/indash_blog")
 	if err != nil {
 		panic(err)
 	}
@@ -720,7 +1136,31 @@ func (sc *scrapeContext) getIndashBlogPostsURL() *url.URL {
 	return u
 }
 
-func (sc *scrapeContext) doGetRequest(url *url.URL, header http.Header) (*http.Response, error) {
+// doGetRequest sends a GET request, waiting for the rate limit if necessary.
+// The endpoint is only used to categorize the request in the metrics.
+// doGetRequest sends a request to the Tumblr API or the indash API, which are subject to the
+// rate limits of the API key. Media files on the other hand are served by a CDN without those.
+func (sc *scrapeContext) doGetRequest(endpoint string, url *url.URL, header http.Header) (*http.Response, error) {
+	for {
+		err := sc.scraper.limiter.wait(sc.ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := sc.doRequest(sc.ctx, sc.scraper.client, endpoint, url, header)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sc.scraper.limiter.update(res) {
+			return res, nil
+		}
+
+		_ = res.Body.Close()
+	}
+}
+
+func (sc *scrapeContext) doRequest(ctx context.Context, client *http.Client, endpoint string, url *url.URL, header http.Header) (*http.Response, error) {
 	if header == nil {
 		header = make(http.Header)
 	}
@@ -730,11 +1170,19 @@ func (sc *scrapeContext) doGetRequest(url *url.URL, header http.Header) (*http.R
 		URL:    url,
 		Header: header,
 	}
-	req = req.WithContext(sc.ctx)
-	return sc.scraper.client.Do(req)
+	req = req.WithContext(ctx)
+
+	res, err := client.Do(req)
+	if err != nil {
+		metrics.Requests.Inc(endpoint, "error")
+		return nil, err
+	}
+	metrics.Requests.Inc(endpoint, strconv.Itoa(res.StatusCode))
+
+	return res, nil
 }
 
-func (sc *scrapeContext) fixupURL(url string) string {
+func fixupURL(url string) string {
 	if strings.HasSuffix(url, ".mp4") {
 		return videoURLFixupRegexp.ReplaceAllString(url, ".mp4")
 	}
@@ -745,33 +1193,39 @@ func (sc *scrapeContext) fixupURL(url string) string {
 // Tumblr suffixes some files with an invalid extension, like .gifv for instance.
 // The response then includes an Content-Disposition header with the actual, supposed "filename".
 // Furthermore a Content-Type header is sent with a MIME type which we use as a fallback.
-func (sc *scrapeContext) fixupFilepath(res *http.Response, path string) string {
+//
+// The fixed up {name} and {ext} are written back into vars and the filename template is applied again.
+func (sc *scrapeContext) fixupFilepath(res *http.Response, vars *filenameVars) string {
 	// The Content-Disposition header can include a "filename" a browser is supposed to use to name the downloaded file.
 	_, contentDispositionParams, _ := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
 	if contentDispositionParams != nil {
 		filename := contentDispositionParams["filename"]
 		if len(filename) != 0 {
-			return filepath.Join(sc.blogConfig.Target, filename)
+			filename = filepath.Base(filename)
+			vars.ext = filepath.Ext(filename)
+			vars.name = strings.TrimSuffix(filename, vars.ext)
+			return sc.filepath(vars)
 		}
 	}
 
-	exts, _ := mime.ExtensionsByType(res.Header.Get("Content-Type"))
+	contentType := res.Header.Get("Content-Type")
+	exts, _ := mime.ExtensionsByType(contentType)
 	if len(exts) != 0 {
-		dir, file := filepath.Split(path)
-		curExt := filepath.Ext(file)
-
 		for _, ext := range exts {
-			if ext == curExt {
+			if ext == vars.ext {
 				// There's nothing we need to do if one of the extensions suggested
 				// by the Content-Type already matches what we use for "path".
-				return path
+				return sc.filepath(vars)
 			}
 		}
 
-		basename := strings.TrimSuffix(file, curExt)
-		file = basename + exts[0]
-		return filepath.Join(dir, file)
+		vars.ext = exts[0]
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			if ext, ok := preferredExtensions[mediaType]; ok {
+				vars.ext = ext
+			}
+		}
 	}
 
-	return path
+	return sc.filepath(vars)
 }
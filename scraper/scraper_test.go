@@ -0,0 +1,541 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/account"
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/cookiejar"
+	"github.com/lhecker/tumblr-scraper/database"
+	"github.com/lhecker/tumblr-scraper/events"
+	"github.com/lhecker/tumblr-scraper/faketumblr"
+)
+
+const (
+	testBlogName = "example.tumblr.com"
+
+	// If set, the test binary acts as an external downloader instead, see runFakeExternalDownloader.
+	fakeExternalDownloaderEnv = "TUMBLR_SCRAPER_FAKE_EXTERNAL_DOWNLOADER"
+)
+
+func TestMain(m *testing.M) {
+	if len(os.Getenv(fakeExternalDownloaderEnv)) != 0 {
+		os.Exit(runFakeExternalDownloader(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeExternalDownloader imitates yt-dlp invoked as
+//
+//	--print after_move:filepath -o {output} -- {url}
+//
+// by writing the URL into the file at the output template with the ID "video" and extension "mp4".
+func runFakeExternalDownloader(args []string) int {
+	var output string
+	for i, arg := range args {
+		if arg == "-o" && i+1 < len(args) {
+			output = args[i+1]
+		}
+	}
+	rawurl := args[len(args)-1]
+
+	path := strings.NewReplacer("%(id)s", "video", "%(ext)s", "mp4").Replace(output)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(rawurl), 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 1
+	}
+
+	fmt.Println(path)
+	return 0
+}
+
+// testEnv is a scraper running against a faketumblr.Server.
+type testEnv struct {
+	t       *testing.T
+	dir     string
+	server  *faketumblr.Server
+	config  *config.Config
+	blog    *config.BlogConfig
+	db      *database.Database
+	scraper *Scraper
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "tumblr-scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := faketumblr.NewServer()
+
+	db, err := database.NewDatabase(filepath.Join(dir, "tumblr.db"))
+	if err != nil {
+		server.Close()
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		APIKey:      "api-key",
+		Concurrency: 4,
+		APIBaseURL:  server.URL,
+		WebBaseURL:  server.URL,
+	}
+	blog := &config.BlogConfig{
+		Name:   testBlogName,
+		Target: filepath.Join(dir, "example"),
+	}
+	cfg.Blogs = config.BlogList{blog}
+
+	client := &http.Client{Jar: cookiejar.New(nil)}
+	account.Setup(client, cfg)
+
+	return &testEnv{
+		t:       t,
+		dir:     dir,
+		server:  server,
+		config:  cfg,
+		blog:    blog,
+		db:      db,
+		scraper: NewScraper(client, cfg, db),
+	}
+}
+
+func (s *testEnv) Close() {
+	_ = s.db.Close()
+	s.server.Close()
+	_ = os.RemoveAll(s.dir)
+}
+
+// photoPost returns a legacy photo post with a single photo, which is registered as media at the server.
+func (s *testEnv) photoPost(id int64, fields map[string]interface{}) *faketumblr.Post {
+	url := s.server.AddMedia(fmt.Sprintf("photo%d.jpg", id), "image/jpeg", []byte(fmt.Sprintf("photo %d", id)))
+
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["type"] = "photo"
+	fields["photos"] = []interface{}{
+		map[string]interface{}{
+			"original_size": map[string]interface{}{"url": url, "width": 100, "height": 100},
+		},
+	}
+
+	return &faketumblr.Post{
+		ID:        id,
+		Timestamp: 1500000000 + id*3600,
+		Fields:    fields,
+	}
+}
+
+func (s *testEnv) addPhotoPosts(private bool, from, to int64) {
+	posts := make([]*faketumblr.Post, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		posts = append(posts, s.photoPost(id, nil))
+	}
+	s.server.AddBlog(testBlogName, private, posts...)
+}
+
+// update scrapes the blog and saves its highest ID, just like the update command.
+func (s *testEnv) update() int64 {
+	highestID, err := s.scraper.Scrape(context.Background(), s.blog)
+	if err != nil {
+		s.t.Fatalf("failed to scrape: %v", err)
+	}
+
+	err = s.db.SetHighestID(s.blog.Name, highestID)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return highestID
+}
+
+// useAccount configures matching credentials for the server and the scraper.
+func (s *testEnv) useAccount() {
+	s.server.Username = "user@example.com"
+	s.server.Password = "password"
+	s.config.Username = s.server.Username
+	s.config.Password = s.server.Password
+}
+
+func (s *testEnv) hasPhoto(id int64) bool {
+	_, err := os.Stat(filepath.Join(s.blog.Target, fmt.Sprintf("photo%d.jpg", id)))
+	return err == nil
+}
+
+func (s *testEnv) countRequests(pathPrefix string) int {
+	n := 0
+	for _, r := range s.server.Requests() {
+		if strings.HasPrefix(r.Path, pathPrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestScrapePagination(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.addPhotoPosts(false, 1, 45)
+
+	if highestID := env.update(); highestID != 45 {
+		t.Fatalf("highest ID is %d, expected 45", highestID)
+	}
+	for id := int64(1); id <= 45; id++ {
+		if !env.hasPhoto(id) {
+			t.Errorf("photo of post %d is missing", id)
+		}
+	}
+	// 3 pages of posts and a final empty one.
+	if n := env.countRequests("/v2/blog/"); n != 4 {
+		t.Errorf("fetched %d pages, expected 4", n)
+	}
+
+	// Subsequent updates stop at the previously highest ID.
+	env.addPhotoPosts(false, 46, 50)
+	before := env.countRequests("/v2/blog/")
+
+	if highestID := env.update(); highestID != 50 {
+		t.Fatalf("highest ID is %d, expected 50", highestID)
+	}
+	for id := int64(46); id <= 50; id++ {
+		if !env.hasPhoto(id) {
+			t.Errorf("photo of post %d is missing", id)
+		}
+	}
+	if n := env.countRequests("/v2/blog/") - before; n != 1 {
+		t.Errorf("fetched %d pages, expected 1", n)
+	}
+}
+
+func TestScrapeIndashFallback(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.useAccount()
+	defer func() { _ = account.Logout() }()
+
+	// Private blogs aren't available using the API and require a login for the indash API.
+	env.addPhotoPosts(true, 1, 30)
+
+	if highestID := env.update(); highestID != 30 {
+		t.Fatalf("highest ID is %d, expected 30", highestID)
+	}
+	for id := int64(1); id <= 30; id++ {
+		if !env.hasPhoto(id) {
+			t.Errorf("photo of post %d is missing", id)
+		}
+	}
+	if n := env.server.Logins(); n != 1 {
+		t.Errorf("logged in %d times, expected once", n)
+	}
+	if n := env.countRequests("/v2/blog/"); n != 1 {
+		t.Errorf("tried the API %d times, expected once", n)
+	}
+	if n := env.countRequests("/svc/indash_blog"); n < 3 {
+		t.Errorf("fetched %d pages using the indash API, expected at least 3", n)
+	}
+}
+
+func TestScrapeReblogFiltering(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.blog.AllowReblogsFrom = &[]string{"friend.tumblr.com"}
+
+	env.server.AddBlog(testBlogName, false,
+		env.photoPost(1, nil),
+		env.photoPost(2, map[string]interface{}{
+			"reblogged_root_name": "friend",
+			"reblogged_from_name": "friend",
+		}),
+		env.photoPost(3, map[string]interface{}{
+			"reblogged_root_name": "stranger",
+			"reblogged_from_name": "friend",
+		}),
+		env.photoPost(4, map[string]interface{}{
+			"reblogged_from_name": "stranger",
+		}),
+	)
+
+	if highestID := env.update(); highestID != 4 {
+		t.Fatalf("highest ID is %d, expected 4", highestID)
+	}
+
+	for id, expected := range map[int64]bool{1: true, 2: true, 3: false, 4: false} {
+		if env.hasPhoto(id) != expected {
+			t.Errorf("photo of post %d exists: %v, expected %v", id, !expected, expected)
+		}
+	}
+}
+
+func TestScrapeDateWindowKeepsHighestID(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.useAccount()
+	defer func() { _ = account.Logout() }()
+
+	// The indash API doesn't support the "before" parameter,
+	// which is why the posts newer than the window are fetched, but skipped.
+	env.addPhotoPosts(true, 1, 45)
+
+	before := &config.DateBound{}
+	err := before.UnmarshalText([]byte(time.Unix(1500000000+30*3600, 0).UTC().Format(time.RFC3339)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.blog.Before = before
+
+	if highestID := env.update(); highestID != 0 {
+		t.Fatalf("highest ID is %d after a windowed scrape, expected 0", highestID)
+	}
+	for id := int64(1); id <= 45; id++ {
+		if env.hasPhoto(id) != (id < 30) {
+			t.Errorf("photo of post %d exists: %v, expected %v", id, id >= 30, id < 30)
+		}
+	}
+
+	// Without the window the skipped posts must still be scraped.
+	env.blog.Before = nil
+
+	if highestID := env.update(); highestID != 45 {
+		t.Fatalf("highest ID is %d, expected 45", highestID)
+	}
+	for id := int64(30); id <= 45; id++ {
+		if !env.hasPhoto(id) {
+			t.Errorf("photo of post %d is missing", id)
+		}
+	}
+}
+
+// eventRecorder is an events.Sink collecting all events.
+type eventRecorder struct {
+	lock   sync.Mutex
+	events []*events.Event
+}
+
+func (s *eventRecorder) Emit(e *events.Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.events = append(s.events, e)
+}
+
+func (s *eventRecorder) paths(typ string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var paths []string
+	for _, e := range s.events {
+		if e.Type == typ {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+func TestScrapeExternalDownload(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	err := os.Setenv(fakeExternalDownloaderEnv, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(fakeExternalDownloaderEnv)
+
+	recorder := &eventRecorder{}
+	env.scraper.SetEventSink(recorder)
+	env.config.ExternalDownloader = &config.ExternalDownloaderConfig{Command: os.Args[0]}
+	env.blog.ArchivePosts = true
+
+	const videoURL = "https://www.youtube.com/watch?v=abc"
+	env.server.AddBlog(testBlogName, false, &faketumblr.Post{
+		ID:        1,
+		Timestamp: 1500000000,
+		Fields: map[string]interface{}{
+			"type":    "blocks",
+			"content": []interface{}{map[string]interface{}{"type": "video", "url": videoURL}},
+		},
+	})
+
+	env.update()
+
+	// The path printed by the downloader is recorded instead of the output template.
+	expected := filepath.Join(env.blog.Target, "video.mp4")
+
+	download, err := env.db.GetExternalDownload(env.blog.Name, videoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download == nil || download.Output != expected {
+		t.Errorf("recorded download %+v, expected the output %s", download, expected)
+	}
+
+	if paths := recorder.paths(events.FileWritten); len(paths) != 1 || paths[0] != expected {
+		t.Errorf("file_written events for %v, expected %s", paths, expected)
+	}
+
+	records, err := readPostArchive(env.blog.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Files) != 1 || records[0].Files[0] != "video.mp4" {
+		t.Errorf("archived %+v, expected a post with the file video.mp4", records)
+	}
+}
+
+func TestScrapeAudioExtension(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Legacy audio posts link to files without an extension, which is derived from their Content-Type instead.
+	for id, contentType := range map[int64]string{1: "audio/mpeg", 2: "audio/mp4"} {
+		url := env.server.AddMedia(fmt.Sprintf("audio_file/example.tumblr.com/%d/tumblr_audio%d", id, id), contentType, []byte("audio"))
+		env.server.AddBlog(testBlogName, false, &faketumblr.Post{
+			ID:        id,
+			Timestamp: 1500000000 + id,
+			Fields:    map[string]interface{}{"type": "audio", "audio_url": url},
+		})
+	}
+
+	env.update()
+
+	for _, name := range []string{"tumblr_audio1.mp3", "tumblr_audio2.m4a"} {
+		_, err := os.Stat(filepath.Join(env.blog.Target, name))
+		if err != nil {
+			t.Errorf("audio file is missing: %v", err)
+		}
+	}
+}
+
+func TestScrapeIndexIgnoresFilters(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.blog.FilenameTemplate = "{post_id}_{index}{ext}"
+	env.blog.MinWidth = 500
+
+	var photos []interface{}
+	for i, width := range []int{100, 1000} {
+		url := env.server.AddMedia(fmt.Sprintf("photo1_%d.jpg", i), "image/jpeg", []byte("photo"))
+		photos = append(photos, map[string]interface{}{
+			"original_size": map[string]interface{}{"url": url, "width": width, "height": 1000},
+		})
+	}
+	env.server.AddBlog(testBlogName, false, &faketumblr.Post{
+		ID:        1,
+		Timestamp: 1500000000,
+		Fields:    map[string]interface{}{"type": "photo", "photos": photos},
+	})
+
+	env.update()
+
+	// The first photo is too small, but the second one still keeps its index.
+	for name, expected := range map[string]bool{"1_0.jpg": false, "1_1.jpg": true} {
+		_, err := os.Stat(filepath.Join(env.blog.Target, name))
+		if (err == nil) != expected {
+			t.Errorf("%s exists: %v, expected %v", name, err == nil, expected)
+		}
+	}
+}
+
+// cancelOnFile is an events.Sink cancelling the scrape once a file with the given suffix has been written.
+type cancelOnFile struct {
+	suffix string
+	cancel context.CancelFunc
+}
+
+func (s *cancelOnFile) Emit(e *events.Event) {
+	if e.Type == events.FileWritten && strings.HasSuffix(e.Path, s.suffix) {
+		s.cancel()
+	}
+}
+
+// scrapeCancelledAfter scrapes the blog one download at a time and cancels the scrape right after
+// the file with the given suffix has been written, followed by a regular update resuming the scrape.
+func (s *testEnv) scrapeCancelledAfter(suffix string) {
+	s.config.Concurrency = 1
+	s.scraper = NewScraper(s.scraper.client, s.config, s.db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.scraper.SetEventSink(&cancelOnFile{suffix, cancel})
+	_, err := s.scraper.Scrape(ctx, s.blog)
+	if err == nil {
+		s.t.Fatal("expected the scrape to be cancelled")
+	}
+
+	s.scraper.SetEventSink(nil)
+	s.update()
+}
+
+func TestScrapeResumeArchivesAllPosts(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.blog.ArchivePosts = true
+	env.addPhotoPosts(false, 1, 45)
+
+	// Post 26 is the last one of the first page.
+	env.scrapeCancelledAfter("photo26.jpg")
+
+	records, err := readPostArchive(env.blog.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archived := make(map[int64]bool, len(records))
+	for _, record := range records {
+		archived[record.ID] = true
+	}
+	for id := int64(1); id <= 45; id++ {
+		if !archived[id] {
+			t.Errorf("post %d is missing from the archive", id)
+		}
+	}
+}
+
+func TestScrapeResumeExportsAllPosts(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.blog.ExportPosts = config.ExportMarkdown
+
+	// Text posts inlining a photo, whose export waits for the download.
+	for id := int64(1); id <= 45; id++ {
+		url := env.server.AddMedia(fmt.Sprintf("64.media.tumblr.com/photo%d.jpg", id), "image/jpeg", []byte("photo"))
+		env.server.AddBlog(testBlogName, false, &faketumblr.Post{
+			ID:        id,
+			Timestamp: 1500000000 + id*3600,
+			Fields:    map[string]interface{}{"type": "text", "body": fmt.Sprintf(`<p><img src="%s"></p>`, url)},
+		})
+	}
+
+	// Post 26 is the last one of the first page.
+	env.scrapeCancelledAfter("photo26.jpg")
+
+	for id := int64(1); id <= 45; id++ {
+		_, err := os.Stat(filepath.Join(env.blog.Target, exportDirectory, fmt.Sprintf("%d.md", id)))
+		if err != nil {
+			t.Errorf("post %d hasn't been exported: %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package scraper
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+// The database snapshot is refreshed at most this often.
+const serveSnapshotInterval = 5 * time.Second
+
+var serveStatusTemplate = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tumblr-scraper</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 1200px; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .5em; border-bottom: 1px solid #ddd; vertical-align: top; }
+</style>
+</head>
+<body>
+<h1>Blogs</h1>
+<table>
+<tr><th>Blog</th><th>Highest ID</th><th>Last run</th><th>In progress</th><th>Scraped dates</th><th>Failed downloads</th></tr>
+{{range .}}<tr>
+<td><a href="{{.URL}}">{{.Name}}</a></td>
+<td>{{if .HighestID}}{{.HighestID}}{{else}}-{{end}}</td>
+<td>{{if .LastRun.IsZero}}never{{else}}{{.LastRun.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{with .Checkpoint}}{{.Offset}} posts, before {{.Before.Format "2006-01-02"}}{{else}}-{{end}}</td>
+<td>{{range .Coverage}}{{if .From.IsZero}}start{{else}}{{.From.Format "2006-01-02"}}{{end}} to {{.To.Format "2006-01-02"}}<br>{{else}}-{{end}}</td>
+<td>{{len .Failed}}{{range .Failed}}<br><small>{{.URL}}: {{.Error}}</small>{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type blogStatus struct {
+	Name       string
+	URL        string
+	HighestID  int64
+	LastRun    time.Time
+	Checkpoint *database.Checkpoint
+	Coverage   []database.DateRange
+	Failed     []*database.FailedDownload
+}
+
+// server serves the web UI of Serve.
+type server struct {
+	cfg         *config.Config
+	blogs       map[string]*config.BlogConfig
+	dbPath      string
+	snapshotDir string
+
+	// Serializes refreshing the database snapshot and protects the fields below.
+	// It's separate from lock, so that copying the database doesn't block requests.
+	refreshLock sync.Mutex
+
+	dbModTime   time.Time
+	dbCheckedAt time.Time
+	snapshots   int
+
+	// Protects all fields below.
+	lock sync.Mutex
+
+	db         *database.Database
+	dbSnapshot string
+	dbVersion  int
+
+	sites map[string]*serverSite
+}
+
+type serverSite struct {
+	site           *site
+	archiveModTime time.Time
+	dbVersion      int
+}
+
+// Serve starts a web UI on addr, which shows the scrape status of all configured blogs
+// and allows browsing and searching their post archives, just like the sites generated by Render.
+// The database is only read using snapshots (see database.NewSnapshot), so that it can run alongside a scrape.
+func Serve(ctx context.Context, cfg *config.Config, dbPath string, addr string) error {
+	dir, err := ioutil.TempDir("", "tumblr-scraper")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	s := &server{
+		cfg:         cfg,
+		blogs:       make(map[string]*config.BlogConfig, len(cfg.Blogs)),
+		dbPath:      dbPath,
+		snapshotDir: dir,
+		sites:       make(map[string]*serverSite),
+	}
+	for _, blog := range cfg.Blogs {
+		s.blogs[blog.Name] = blog
+	}
+	defer s.close()
+
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: s,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Shutdown(context.Background())
+	}()
+
+	log.Printf("serving on http://%s", addr)
+
+	err = httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *server) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.db != nil {
+		_ = s.db.Close()
+		s.db = nil
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		s.handleStatus(w, r)
+		return
+	}
+
+	// /blog/{name}/site/... renders the site and /blog/{name}/... serves the downloaded files.
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) < 2 || parts[0] != "blog" {
+		http.NotFound(w, r)
+		return
+	}
+
+	blog := s.blogs[parts[1]]
+	if blog == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rest := ""
+	if len(parts) == 3 {
+		rest = parts[2]
+	}
+
+	if rest == siteDirectory {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	if strings.HasPrefix(rest, siteDirectory+"/") {
+		s.handleSite(w, r, blog, strings.TrimPrefix(rest, siteDirectory+"/"))
+		return
+	}
+
+	http.StripPrefix("/blog/"+blog.Name, http.FileServer(http.Dir(blog.Target))).ServeHTTP(w, r)
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	err := s.refreshDatabase()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	db := s.db
+
+	failed, err := db.GetFailedDownloads()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	statuses := make([]*blogStatus, 0, len(s.cfg.Blogs))
+	for _, blog := range s.cfg.Blogs {
+		status := &blogStatus{
+			Name: blog.Name,
+			URL:  "/blog/" + url.PathEscape(blog.Name) + "/" + siteDirectory + "/index.html",
+		}
+
+		status.HighestID, err = db.GetHighestID(blog.Name)
+		if err == nil {
+			status.LastRun, err = db.GetLastRun(blog.Name)
+		}
+		if err == nil {
+			status.Checkpoint, err = db.GetCheckpoint(blog.Name)
+		}
+		if err == nil {
+			status.Coverage, err = db.GetCoverage(blog.Name)
+		}
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, fd := range failed {
+			if fd.Blog == blog.Name {
+				status.Failed = append(status.Failed, fd)
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = serveStatusTemplate.Execute(w, statuses)
+	if err != nil {
+		log.Printf("failed to render status: %v", err)
+	}
+}
+
+func (s *server) handleSite(w http.ResponseWriter, r *http.Request, blog *config.BlogConfig, path string) {
+	err := s.refreshDatabase()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	site, err := s.site(blog)
+	if os.IsNotExist(err) {
+		http.Error(w, "no post archive found - enable archive_posts for this blog", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	search := &siteSearch{
+		Tag:  query.Get("tag"),
+		From: query.Get("from"),
+		To:   query.Get("to"),
+	}
+
+	var page *sitePage
+	name := "list"
+
+	switch dir, file := filepath.Split(filepath.FromSlash(path)); {
+	case path == "tags.html":
+		page = site.newPage("Tags", "")
+		page.Tags = site.tagList
+		name = "tagIndex"
+	case dir == "post"+string(filepath.Separator):
+		id, _ := strconv.ParseInt(strings.TrimSuffix(file, ".html"), 10, 64)
+		p := site.byID[id]
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		page = site.newPage(p.Title, "../")
+		page.Post = p
+		name = "post"
+	case dir == "tag"+string(filepath.Separator):
+		base, n := parseSitePageFilename(file)
+		t := site.tags[base]
+		if t == nil {
+			http.NotFound(w, r)
+			return
+		}
+		page = site.newPage("#"+t.Name, "../")
+		page.list(base, t.posts, n, "")
+	case dir == "":
+		if len(file) == 0 {
+			file = "index.html"
+		}
+		base, n := parseSitePageFilename(file)
+		if base != "index" {
+			http.NotFound(w, r)
+			return
+		}
+
+		posts, err := site.search(search)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		title := site.name
+		if *search != (siteSearch{}) {
+			title = "Search results"
+		}
+		page = site.newPage(title, "")
+		page.list(base, posts, n, r.URL.RawQuery)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	page.Search = search
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = siteTemplates.ExecuteTemplate(w, name, page)
+	if err != nil {
+		log.Printf("failed to render %s: %v", r.URL.Path, err)
+	}
+}
+
+// refreshDatabase replaces the snapshot of the database if it changed.
+// The database is copied without holding lock, as that can take a while for large databases.
+func (s *server) refreshDatabase() error {
+	s.refreshLock.Lock()
+	defer s.refreshLock.Unlock()
+
+	now := time.Now()
+	if !s.dbModTime.IsZero() && now.Sub(s.dbCheckedAt) < serveSnapshotInterval {
+		return nil
+	}
+
+	info, err := os.Stat(s.dbPath)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(s.dbModTime) {
+		s.dbCheckedAt = now
+		return nil
+	}
+
+	// Requests keep using the previous snapshot until the new one is ready, which is why they need separate files.
+	s.snapshots++
+	path := filepath.Join(s.snapshotDir, fmt.Sprintf("tumblr-%d.db", s.snapshots))
+
+	db, err := database.NewSnapshot(s.dbPath, path)
+	if err != nil {
+		return err
+	}
+
+	s.dbModTime = info.ModTime()
+	s.dbCheckedAt = now
+
+	s.lock.Lock()
+	prev, prevPath := s.db, s.dbSnapshot
+	s.db = db
+	s.dbSnapshot = path
+	s.dbVersion++
+	s.lock.Unlock()
+
+	if prev != nil {
+		_ = prev.Close()
+		_ = os.Remove(prevPath)
+	}
+
+	return nil
+}
+
+// site returns the site of the blog, which is rebuilt if its post archive or the database changed.
+func (s *server) site(blog *config.BlogConfig) (*site, error) {
+	info, err := os.Stat(filepath.Join(blog.Target, postArchiveFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	cached := s.sites[blog.Name]
+	if cached != nil && cached.dbVersion == s.dbVersion && cached.archiveModTime.Equal(info.ModTime()) {
+		return cached.site, nil
+	}
+
+	records, err := readPostArchive(blog.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	site, err := newSite(blog, s.db, records)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sites[blog.Name] = &serverSite{
+		site:           site,
+		archiveModTime: info.ModTime(),
+		dbVersion:      s.dbVersion,
+	}
+	return site, nil
+}
+
+// search returns the posts matching the tag and published within the date range, which are both optional.
+func (s *site) search(search *siteSearch) ([]*sitePost, error) {
+	if *search == (siteSearch{}) {
+		return s.posts, nil
+	}
+
+	var from, to time.Time
+	var err error
+
+	if len(search.From) != 0 {
+		from, err = time.Parse("2006-01-02", search.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(search.To) != 0 {
+		to, err = time.Parse("2006-01-02", search.To)
+		if err != nil {
+			return nil, err
+		}
+		// The end date is inclusive.
+		to = to.AddDate(0, 0, 1)
+	}
+
+	tag := strings.ToLower(search.Tag)
+
+	var posts []*sitePost
+	for _, p := range s.posts {
+		if !from.IsZero() && p.timestamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !p.timestamp.Before(to) {
+			continue
+		}
+		if len(tag) != 0 && !p.hasTag(tag) {
+			continue
+		}
+		posts = append(posts, p)
+	}
+
+	return posts, nil
+}
+
+func (s *sitePost) hasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if strings.ToLower(t.Name) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSitePageFilename is the inverse of sitePageFilename.
+func parseSitePageFilename(file string) (string, int) {
+	base := strings.TrimSuffix(file, ".html")
+
+	if idx := strings.LastIndexByte(base, '-'); idx >= 0 {
+		n, err := strconv.Atoi(base[idx+1:])
+		if err == nil && n > 1 {
+			return base[:idx], n
+		}
+	}
+
+	return base, 1
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Printf("failed to serve request: %v", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,204 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+var (
+	errTruncated = errors.New("file is truncated")
+
+	pngTrailer = []byte("\x00\x00\x00\x00IEND\xaeB`\x82")
+)
+
+// Verify checks the files in the target directories of all configured blogs for
+// mismatching sizes and hashes if they were recorded during the download, or for truncation otherwise.
+// If requeue is true, broken files are removed and recorded as failed downloads,
+// so that they can be downloaded again using RetryFailed.
+// It returns the number of broken files.
+func Verify(ctx context.Context, cfg *config.Config, db *database.Database, requeue bool) (int, error) {
+	broken := 0
+
+	for _, blog := range cfg.Blogs {
+		err := filepath.Walk(blog.Target, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Files deduplicated using symlinks are verified through the stored copy they link to.
+			if info.Mode()&os.ModeSymlink != 0 {
+				if target, err := os.Stat(path); err == nil {
+					info = target
+				}
+			}
+			if !info.Mode().IsRegular() || info.Name() == postArchiveFilename || filepath.Ext(path) == partExtension {
+				return nil
+			}
+
+			record, err := db.GetFileRecord(path)
+			if err != nil {
+				return err
+			}
+
+			verifyErr := verifyFile(path, info, record)
+			if verifyErr == nil {
+				return nil
+			}
+
+			broken++
+			log.Printf("%s: %s is broken: %v", blog.Name, path, verifyErr)
+
+			if requeue {
+				if record == nil {
+					log.Printf("%s: cannot requeue %s - it has no download record", blog.Name, path)
+					return nil
+				}
+
+				err = os.Remove(path)
+				if err != nil {
+					return err
+				}
+
+				return db.AddFailedDownload(&database.FailedDownload{
+					Blog:     record.Blog,
+					PostID:   record.PostID,
+					URL:      record.URL,
+					Error:    verifyErr.Error(),
+					FailedAt: time.Now(),
+					Index:    record.Index,
+					Path:     path,
+					FileTime: info.ModTime(),
+				})
+			}
+
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return broken, err
+		}
+	}
+
+	return broken, nil
+}
+
+func verifyFile(path string, info os.FileInfo, record *database.FileRecord) error {
+	if record != nil {
+		if info.Size() != record.Size {
+			return fmt.Errorf("size is %d but should be %d", info.Size(), record.Size)
+		}
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if hash != record.SHA256 {
+			return errors.New("hash mismatch")
+		}
+
+		// The file is exactly what was downloaded. The heuristics below would only report false positives,
+		// e.g. for the JPEGs served by Tumblr's CDN, which frequently contain data after their trailer.
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		return verifyTrailer(f, info.Size(), []byte{0xff, 0xd9})
+	case ".png":
+		return verifyTrailer(f, info.Size(), pngTrailer)
+	case ".gif":
+		return verifyTrailer(f, info.Size(), []byte{0x3b})
+	case ".webp":
+		return verifyRIFF(f, info.Size())
+	case ".mp4", ".m4v", ".m4a", ".mov":
+		return verifyISOBMFF(f, info.Size())
+	}
+
+	return nil
+}
+
+// verifyTrailer checks whether the file ends with the trailer of its format.
+func verifyTrailer(f *os.File, size int64, trailer []byte) error {
+	if size < int64(len(trailer)) {
+		return errTruncated
+	}
+
+	buf := make([]byte, len(trailer))
+	_, err := f.ReadAt(buf, size-int64(len(trailer)))
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(buf, trailer) {
+		return errTruncated
+	}
+	return nil
+}
+
+// verifyRIFF checks whether the file size matches the one in the RIFF header (used by WebP).
+func verifyRIFF(f *os.File, size int64) error {
+	var header [8]byte
+	_, err := f.ReadAt(header[:], 0)
+	if err != nil {
+		return errTruncated
+	}
+
+	if string(header[0:4]) != "RIFF" || int64(binary.LittleEndian.Uint32(header[4:8]))+8 > size {
+		return errTruncated
+	}
+	return nil
+}
+
+// verifyISOBMFF walks the top-level boxes of an MP4 file and checks whether they add up to its size.
+func verifyISOBMFF(f *os.File, size int64) error {
+	var header [16]byte
+
+	for offset := int64(0); offset < size; {
+		_, err := f.ReadAt(header[:8], offset)
+		if err != nil {
+			return errTruncated
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		switch boxSize {
+		case 0:
+			// The box extends to the end of the file.
+			return nil
+		case 1:
+			_, err = f.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return errTruncated
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+
+		if boxSize < 8 {
+			return fmt.Errorf("invalid box size %d at offset %d", boxSize, offset)
+		}
+
+		offset += boxSize
+		if offset > size {
+			return errTruncated
+		}
+	}
+
+	return nil
+}
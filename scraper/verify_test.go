@@ -0,0 +1,112 @@
+package scraper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lhecker/tumblr-scraper/database"
+)
+
+func TestVerifyFileTrustsRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tumblr-scraper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// JPEGs served by Tumblr's CDN may contain data after their trailer.
+	path := filepath.Join(dir, "photo.jpg")
+	err = ioutil.WriteFile(path, []byte("\xff\xd8data\xff\xd9trailing"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyFile(path, info, &database.FileRecord{Size: info.Size(), SHA256: hash})
+	if err != nil {
+		t.Errorf("file matching its record is broken: %v", err)
+	}
+
+	err = verifyFile(path, info, &database.FileRecord{Size: info.Size(), SHA256: "0000"})
+	if err == nil {
+		t.Error("file with a mismatching hash isn't broken")
+	}
+
+	err = verifyFile(path, info, nil)
+	if err != errTruncated {
+		t.Errorf("file without a record: got %v, expected errTruncated", err)
+	}
+}
+
+func TestVerifyRequeueRestoresPath(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.blog.FilenameTemplate = "{year}/{post_id}_{index}{ext}"
+	env.addPhotoPosts(false, 1, 1)
+	env.update()
+
+	path := filepath.Join(env.blog.Target, "2017", "1_0.jpg")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the file without changing its modification time.
+	err = ioutil.WriteFile(path, []byte("broken"), 0644)
+	if err == nil {
+		err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken, err := Verify(context.Background(), env.config, env.db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if broken != 1 {
+		t.Fatalf("found %d broken files, expected 1", broken)
+	}
+
+	// The file is downloaded to its previous path, even though its post is unknown.
+	err = env.scraper.RetryFailed(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "photo 1" {
+		t.Errorf("file contains %q after retrying", data)
+	}
+
+	restored, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.ModTime().Equal(info.ModTime()) {
+		t.Errorf("modification time is %v, expected %v", restored.ModTime(), info.ModTime())
+	}
+
+	failed, err := env.db.GetFailedDownloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("%d failed downloads remain", len(failed))
+	}
+}
@@ -1,5 +1,9 @@
 package semaphore
 
+import (
+	"context"
+)
+
 type Semaphore struct {
 	waiters chan struct{}
 }
@@ -21,6 +25,15 @@ func (s Semaphore) Acquire() {
 	s.waiters <- struct{}{}
 }
 
+func (s Semaphore) AcquireContext(ctx context.Context) error {
+	select {
+	case s.waiters <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (s Semaphore) Release() {
 	<-s.waiters
 }
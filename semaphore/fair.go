@@ -0,0 +1,118 @@
+package semaphore
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// FairSemaphore is a PrioritySemaphore shared between multiple groups.
+// Whenever capacity becomes available it's granted to the waiting group
+// currently holding the fewest permits, so that no group can starve the others.
+// Within a group waiters are served in order of their priority.
+type FairSemaphore struct {
+	lock      sync.Mutex
+	groups    map[string]*fairGroup
+	capacity  int
+	allocated int
+}
+
+type fairGroup struct {
+	waiters   queue
+	allocated int
+}
+
+func NewFairSemaphore(capacity int) *FairSemaphore {
+	if capacity <= 0 {
+		panic("invalid capacity")
+	}
+
+	return &FairSemaphore{
+		capacity: capacity,
+		groups:   make(map[string]*fairGroup),
+	}
+}
+
+// Group returns a view of the semaphore for a single group,
+// which can be used just like a PrioritySemaphore.
+func (s *FairSemaphore) Group(name string) *FairSemaphoreGroup {
+	return &FairSemaphoreGroup{s, name}
+}
+
+func (s *FairSemaphore) Acquire(group string, priority int) {
+	s.lock.Lock()
+
+	g := s.groups[group]
+	if g == nil {
+		g = &fairGroup{waiters: make(queue, 0)}
+		s.groups[group] = g
+	}
+
+	if s.allocated < s.capacity {
+		s.allocated++
+		g.allocated++
+		s.lock.Unlock()
+		return
+	}
+
+	ch := make(chan struct{})
+	heap.Push(&g.waiters, queueEntry{ch, priority})
+
+	s.lock.Unlock()
+
+	<-ch
+}
+
+func (s *FairSemaphore) Release(group string) {
+	s.lock.Lock()
+
+	s.allocated--
+	s.groups[group].allocated--
+
+	for s.allocated < s.capacity {
+		var next *fairGroup
+		for _, g := range s.groups {
+			if g.waiters.Len() != 0 && (next == nil || g.allocated < next.allocated) {
+				next = g
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		e := heap.Pop(&next.waiters).(queueEntry)
+		close(e.ch)
+		s.allocated++
+		next.allocated++
+	}
+
+	s.lock.Unlock()
+}
+
+// Stats returns the number of waiters and permits held by the group.
+func (s *FairSemaphore) Stats(group string) (waiting int, allocated int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	g := s.groups[group]
+	if g == nil {
+		return 0, 0
+	}
+	return g.waiters.Len(), g.allocated
+}
+
+type FairSemaphoreGroup struct {
+	sema *FairSemaphore
+	name string
+}
+
+func (s *FairSemaphoreGroup) Acquire(priority int) {
+	s.sema.Acquire(s.name, priority)
+}
+
+func (s *FairSemaphoreGroup) Release() {
+	s.sema.Release(s.name)
+}
+
+func (s *FairSemaphoreGroup) Stats() (waiting int, allocated int) {
+	return s.sema.Stats(s.name)
+}
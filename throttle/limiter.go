@@ -0,0 +1,135 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lhecker/tumblr-scraper/config"
+)
+
+// Limiter is a token bucket limiting the throughput of all readers wrapped by it.
+// The limit can vary depending on the time of day.
+type Limiter struct {
+	lock         sync.Mutex
+	defaultLimit int64
+	schedule     []window
+	tokens       float64
+	last         time.Time
+}
+
+type window struct {
+	from  int
+	to    int
+	limit int64
+}
+
+// NewLimiter returns nil if cfg doesn't limit the bandwidth.
+// The schedule of cfg must have been validated by the config package.
+func NewLimiter(cfg *config.NetworkConfig) *Limiter {
+	if cfg == nil || (cfg.BandwidthLimit <= 0 && len(cfg.BandwidthSchedule) == 0) {
+		return nil
+	}
+
+	l := &Limiter{
+		defaultLimit: cfg.BandwidthLimit,
+		last:         time.Now(),
+	}
+
+	for _, w := range cfg.BandwidthSchedule {
+		from, to, err := w.Minutes()
+		if err != nil {
+			panic(err)
+		}
+		l.schedule = append(l.schedule, window{from, to, w.Limit})
+	}
+
+	return l
+}
+
+// limitAt returns the limit in bytes per second at the given time, with 0 meaning unlimited.
+func (l *Limiter) limitAt(t time.Time) int64 {
+	minutes := t.Hour()*60 + t.Minute()
+
+	for _, w := range l.schedule {
+		inWindow := false
+		if w.from <= w.to {
+			inWindow = minutes >= w.from && minutes < w.to
+		} else {
+			inWindow = minutes >= w.from || minutes < w.to
+		}
+		if inWindow {
+			return w.limit
+		}
+	}
+
+	return l.defaultLimit
+}
+
+// WaitN blocks until n bytes may be transferred.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.lock.Lock()
+
+	now := time.Now()
+	limit := l.limitAt(now)
+	if limit <= 0 {
+		l.tokens = 0
+		l.last = now
+		l.lock.Unlock()
+		return nil
+	}
+
+	// Allow bursts of up to one second worth of data.
+	l.tokens += now.Sub(l.last).Seconds() * float64(limit)
+	if l.tokens > float64(limit) {
+		l.tokens = float64(limit)
+	}
+	l.last = now
+
+	// The tokens are allowed to become negative, which makes
+	// all future callers wait until the deficit is paid off.
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+
+	l.lock.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(deficit / float64(limit) * float64(time.Second)))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Reader returns r throttled by l. A nil Limiter returns r as is.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{l, ctx, r}
+}
+
+type reader struct {
+	limiter *Limiter
+	ctx     context.Context
+	r       io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		e := r.limiter.WaitN(r.ctx, n)
+		if e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
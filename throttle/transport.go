@@ -0,0 +1,99 @@
+package throttle
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lhecker/tumblr-scraper/semaphore"
+)
+
+// Transport limits the number of concurrent requests per host.
+// A request holds on to its slot until its response body is closed.
+type Transport struct {
+	base  http.RoundTripper
+	exact map[string]*semaphore.Semaphore
+
+	// Sorted by descending length, so that the most specific wildcard matches first.
+	wildcards []wildcard
+}
+
+type wildcard struct {
+	suffix string
+	sema   *semaphore.Semaphore
+}
+
+// NewTransport wraps base with the given limits.
+// Keys of limits are either host names or wildcards like "*.media.tumblr.com".
+func NewTransport(base http.RoundTripper, limits map[string]int) *Transport {
+	t := &Transport{
+		base:  base,
+		exact: make(map[string]*semaphore.Semaphore),
+	}
+
+	for pattern, limit := range limits {
+		if limit <= 0 {
+			continue
+		}
+
+		sema := semaphore.NewSemaphore(limit)
+		if strings.HasPrefix(pattern, "*.") {
+			t.wildcards = append(t.wildcards, wildcard{pattern[1:], sema})
+		} else {
+			t.exact[pattern] = sema
+		}
+	}
+
+	sort.Slice(t.wildcards, func(i, j int) bool {
+		return len(t.wildcards[i].suffix) > len(t.wildcards[j].suffix)
+	})
+
+	return t
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sema := t.semaphoreFor(req.URL.Hostname())
+	if sema == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	err := sema.AcquireContext(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		sema.Release()
+		return nil, err
+	}
+
+	res.Body = &releasingBody{ReadCloser: res.Body, release: sema.Release}
+	return res, nil
+}
+
+func (t *Transport) semaphoreFor(host string) *semaphore.Semaphore {
+	if sema, ok := t.exact[host]; ok {
+		return sema
+	}
+	for _, w := range t.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.sema
+		}
+	}
+	return nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}